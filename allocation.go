@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"carizon-device-plugin/conf"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	defaultDevicePermissions = "rw"
+	annotationValueSeparator = ","
+)
+
+// allocationPlaceholders returns the replacer that expands the allocation
+// template placeholders for the index-th allocated device
+func allocationPlaceholders(d *Device, index int, deviceIDs []string) *strings.Replacer {
+	return strings.NewReplacer(
+		"{ip}", d.IP,
+		"{uuid}", strconv.Itoa(d.UUID),
+		"{index}", strconv.Itoa(index),
+		"{ips}", strings.Join(deviceIDs, ","),
+	)
+}
+
+// buildAllocation expands the allocation template once for every allocated
+// device. Identical entries are only added once and annotation values rendered
+// for the same key are joined together. Entries rendering to the same container
+// path with different host paths or options fail the allocation, one of them
+// would be lost.
+func buildAllocation(tmpl conf.Allocation, devices []*Device, deviceIDs []string) ([]*pluginapi.DeviceSpec, []*pluginapi.Mount, map[string]string, error) {
+	var (
+		specs       []*pluginapi.DeviceSpec
+		mounts      []*pluginapi.Mount
+		annotations map[string]string
+		seenSpecs   = make(map[string]*pluginapi.DeviceSpec)
+		seenMounts  = make(map[string]*pluginapi.Mount)
+	)
+
+	for i, d := range devices {
+		r := allocationPlaceholders(d, i, deviceIDs)
+
+		for _, t := range tmpl.Devices {
+			spec := &pluginapi.DeviceSpec{
+				ContainerPath: r.Replace(t.ContainerPath),
+				HostPath:      r.Replace(t.HostPath),
+				Permissions:   t.Permissions,
+			}
+			if spec.Permissions == "" {
+				spec.Permissions = defaultDevicePermissions
+			}
+			if seen, ok := seenSpecs[spec.ContainerPath]; ok {
+				if seen.HostPath != spec.HostPath || seen.Permissions != spec.Permissions {
+					return nil, nil, nil, fmt.Errorf("conflicting devices %s:%s and %s:%s at container path %s", seen.HostPath, seen.Permissions, spec.HostPath, spec.Permissions, spec.ContainerPath)
+				}
+				continue
+			}
+			seenSpecs[spec.ContainerPath] = spec
+			specs = append(specs, spec)
+		}
+
+		for _, t := range tmpl.Mounts {
+			mount := &pluginapi.Mount{
+				ContainerPath: r.Replace(t.ContainerPath),
+				HostPath:      r.Replace(t.HostPath),
+				ReadOnly:      t.ReadOnly,
+			}
+			if seen, ok := seenMounts[mount.ContainerPath]; ok {
+				if seen.HostPath != mount.HostPath || seen.ReadOnly != mount.ReadOnly {
+					return nil, nil, nil, fmt.Errorf("conflicting mounts %s (read only %t) and %s (read only %t) at container path %s", seen.HostPath, seen.ReadOnly, mount.HostPath, mount.ReadOnly, mount.ContainerPath)
+				}
+				continue
+			}
+			seenMounts[mount.ContainerPath] = mount
+			mounts = append(mounts, mount)
+		}
+
+		for k, v := range tmpl.Annotations {
+			if annotations == nil {
+				annotations = make(map[string]string)
+			}
+			key, value := r.Replace(k), r.Replace(v)
+			old, ok := annotations[key]
+			switch {
+			case !ok:
+				annotations[key] = value
+			case !containsValue(old, value):
+				annotations[key] = old + annotationValueSeparator + value
+			}
+		}
+	}
+
+	return specs, mounts, annotations, nil
+}
+
+// containsValue reports whether every separated part of value is already in values
+func containsValue(values, value string) bool {
+	known := make(map[string]bool)
+	for _, v := range strings.Split(values, annotationValueSeparator) {
+		known[v] = true
+	}
+	for _, v := range strings.Split(value, annotationValueSeparator) {
+		if !known[v] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"carizon-device-plugin/conf"
+)
+
+func TestBuildAllocation(t *testing.T) {
+	devices := []*Device{newTestDevice(318, "10.0.0.1"), newTestDevice(319, "10.0.0.2")}
+	ids := []string{"10.0.0.1", "10.0.0.2"}
+
+	for _, tc := range []struct {
+		name        string
+		tmpl        conf.Allocation
+		devices     []*Device
+		specs       []*pluginapi.DeviceSpec
+		mounts      []*pluginapi.Mount
+		annotations map[string]string
+		err         string
+	}{
+		{
+			name:    "empty template",
+			devices: devices,
+		},
+		{
+			name: "device placeholders and default permissions",
+			tmpl: conf.Allocation{Devices: []conf.DeviceSpec{
+				{ContainerPath: "/dev/j5_{index}", HostPath: "/dev/j5_{uuid}"},
+				{ContainerPath: "/dev/j5_ctl", HostPath: "/dev/j5_ctl", Permissions: "r"},
+			}},
+			devices: devices,
+			specs: []*pluginapi.DeviceSpec{
+				{ContainerPath: "/dev/j5_0", HostPath: "/dev/j5_318", Permissions: "rw"},
+				{ContainerPath: "/dev/j5_ctl", HostPath: "/dev/j5_ctl", Permissions: "r"},
+				{ContainerPath: "/dev/j5_1", HostPath: "/dev/j5_319", Permissions: "rw"},
+			},
+		},
+		{
+			name: "mounts",
+			tmpl: conf.Allocation{Mounts: []conf.Mount{
+				{ContainerPath: "/etc/carizon/{ip}", HostPath: "/etc/carizon/{ip}", ReadOnly: true},
+				{ContainerPath: "/var/log/carizon", HostPath: "/var/log/carizon"},
+			}},
+			devices: devices,
+			mounts: []*pluginapi.Mount{
+				{ContainerPath: "/etc/carizon/10.0.0.1", HostPath: "/etc/carizon/10.0.0.1", ReadOnly: true},
+				{ContainerPath: "/var/log/carizon", HostPath: "/var/log/carizon"},
+				{ContainerPath: "/etc/carizon/10.0.0.2", HostPath: "/etc/carizon/10.0.0.2", ReadOnly: true},
+			},
+		},
+		{
+			name: "conflicting mounts",
+			tmpl: conf.Allocation{Mounts: []conf.Mount{
+				{ContainerPath: "/var/log/carizon", HostPath: "/var/log/carizon/{uuid}"},
+			}},
+			devices: devices,
+			err:     "conflicting mounts /var/log/carizon/318 (read only false) and /var/log/carizon/319 (read only false) at container path /var/log/carizon",
+		},
+		{
+			name: "conflicting devices",
+			tmpl: conf.Allocation{Devices: []conf.DeviceSpec{
+				{ContainerPath: "/dev/j5", HostPath: "/dev/j5_{uuid}"},
+			}},
+			devices: devices,
+			err:     "conflicting devices /dev/j5_318:rw and /dev/j5_319:rw at container path /dev/j5",
+		},
+		{
+			name: "same container path with other permissions",
+			tmpl: conf.Allocation{Devices: []conf.DeviceSpec{
+				{ContainerPath: "/dev/j5_ctl", HostPath: "/dev/j5_ctl"},
+				{ContainerPath: "/dev/j5_ctl", HostPath: "/dev/j5_ctl", Permissions: "r"},
+			}},
+			devices: devices,
+			err:     "conflicting devices /dev/j5_ctl:rw and /dev/j5_ctl:r at container path /dev/j5_ctl",
+		},
+		{
+			name: "annotations of several devices",
+			tmpl: conf.Allocation{Annotations: map[string]string{
+				"cdi.k8s.io/carizon":        "carizon.io/board={ip}",
+				"carizon.io/devices":        "{ips}",
+				"carizon.io/device-{index}": "{uuid}",
+			}},
+			devices: devices,
+			annotations: map[string]string{
+				"cdi.k8s.io/carizon":  "carizon.io/board=10.0.0.1,carizon.io/board=10.0.0.2",
+				"carizon.io/devices":  "10.0.0.1,10.0.0.2",
+				"carizon.io/device-0": "318",
+				"carizon.io/device-1": "319",
+			},
+		},
+		{
+			name: "single device",
+			tmpl: conf.Allocation{
+				Devices:     []conf.DeviceSpec{{ContainerPath: "/dev/j5_{index}", HostPath: "/dev/j5_{uuid}", Permissions: "rwm"}},
+				Annotations: map[string]string{"carizon.io/devices": "{ips}"},
+			},
+			devices:     devices[1:],
+			specs:       []*pluginapi.DeviceSpec{{ContainerPath: "/dev/j5_0", HostPath: "/dev/j5_319", Permissions: "rwm"}},
+			annotations: map[string]string{"carizon.io/devices": "10.0.0.1,10.0.0.2"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			specs, mounts, annotations, err := buildAllocation(tc.tmpl, tc.devices, ids)
+			if tc.err != "" {
+				require.EqualError(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.specs, specs)
+			require.Equal(t, tc.mounts, mounts)
+			require.Equal(t, tc.annotations, annotations)
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+const (
+	chipTypeAffinity = 4
+	locationAffinity = 2
+	tagAffinity      = 1
+)
+
+// preferredDevices picks size device IDs out of available. The devices in
+// mustInclude are always part of the result, kubelet expects them even when the
+// plugin doesn't know them (anymore). The remaining devices are chosen
+// greedily by their affinity (same chip type, location or tag) to the devices
+// already picked. When nothing is related to the current pick, a whole device
+// set (devices sharing chip type and location) is taken, preferring the
+// smallest set that satisfies the rest of the request so that large sets are
+// not broken up. For composed resources only devices of the same set are
+// considered related, which keeps e.g. 4J5 sets together.
+func preferredDevices(devices []*Device, available, mustInclude []string, size int, composed bool) []string {
+	known := make(map[string]*Device, len(devices))
+	for _, d := range devices {
+		known[d.ID] = d
+	}
+
+	var selected []*Device
+	picked := make(map[string]bool)
+	for _, id := range mustInclude {
+		if picked[id] {
+			continue
+		}
+		d, ok := known[id]
+		if !ok {
+			// no topology is known, it has no affinity to the other devices
+			d = &Device{}
+			d.ID = id
+		}
+		selected = append(selected, d)
+		picked[id] = true
+	}
+
+	var remaining []*Device
+	for _, id := range available {
+		if d, ok := known[id]; ok && !picked[id] {
+			remaining = append(remaining, d)
+			picked[id] = true
+		}
+	}
+	sort.Slice(remaining, func(i, j int) bool { return remaining[i].ID < remaining[j].ID })
+
+	take := func(d *Device) {
+		selected = append(selected, d)
+		for i, r := range remaining {
+			if r == d {
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				break
+			}
+		}
+	}
+
+	for len(selected) < size && len(remaining) > 0 {
+		var best *Device
+		bestScore := 0
+		for _, d := range remaining {
+			if score := affinity(selected, d, composed); score > bestScore {
+				best, bestScore = d, score
+			}
+		}
+		if best != nil {
+			take(best)
+			continue
+		}
+
+		group := bestFitSet(remaining, size-len(selected))
+		for _, d := range group {
+			if len(selected) >= size {
+				break
+			}
+			take(d)
+		}
+	}
+
+	ids := make([]string, 0, len(selected))
+	for _, d := range selected {
+		ids = append(ids, d.ID)
+	}
+	return ids
+}
+
+// affinity scores how close device d is to the devices already selected
+func affinity(selected []*Device, d *Device, composed bool) int {
+	score := 0
+	for _, s := range selected {
+		if composed {
+			if setKey(s) == setKey(d) {
+				score += chipTypeAffinity + locationAffinity
+			}
+			continue
+		}
+		if d.ChipType != "" && s.ChipType == d.ChipType {
+			score += chipTypeAffinity
+		}
+		if d.Location != "" && s.Location == d.Location {
+			score += locationAffinity
+		}
+		score += tagAffinity * sharedTags(s.Tags, d.Tags)
+	}
+	return score
+}
+
+// bestFitSet returns the smallest device set holding at least need devices,
+// or the largest set if none is big enough
+func bestFitSet(devices []*Device, need int) []*Device {
+	sets := make(map[string][]*Device)
+	var keys []string
+	for _, d := range devices {
+		key := setKey(d)
+		if _, ok := sets[key]; !ok {
+			keys = append(keys, key)
+		}
+		sets[key] = append(sets[key], d)
+	}
+
+	var fit, largest []*Device
+	for _, key := range keys {
+		set := sets[key]
+		if len(set) >= need && (fit == nil || len(set) < len(fit)) {
+			fit = set
+		}
+		if len(set) > len(largest) {
+			largest = set
+		}
+	}
+	if fit != nil {
+		return fit
+	}
+	return largest
+}
+
+func setKey(d *Device) string {
+	return d.ChipType + "/" + d.Location
+}
+
+func sharedTags(a, b string) int {
+	if a == "" || b == "" {
+		return 0
+	}
+	tags := make(map[string]bool)
+	for _, t := range strings.Split(a, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tags[t] = true
+		}
+	}
+	count := 0
+	for _, t := range strings.Split(b, ",") {
+		if t = strings.TrimSpace(t); tags[t] {
+			count++
+			delete(tags, t)
+		}
+	}
+	return count
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTopologyDevice(ip, chipType, location, tags string) *Device {
+	return buildDevice(&externalDevice{IP: ip, ChipType: chipType, Location: location, Tags: tags})
+}
+
+func TestPreferredDevices(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		devices     []*Device
+		available   []string
+		mustInclude []string
+		size        int
+		composed    bool
+		want        []string
+	}{
+		{
+			name: "must include",
+			devices: []*Device{
+				newTopologyDevice("10.0.0.1", "J5", "rack-1", ""),
+				newTopologyDevice("10.0.0.2", "J5", "rack-2", ""),
+				newTopologyDevice("10.0.0.3", "J5", "rack-2", ""),
+			},
+			available:   []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+			mustInclude: []string{"10.0.0.3"},
+			size:        2,
+			want:        []string{"10.0.0.3", "10.0.0.2"},
+		},
+		{
+			name: "unknown must include",
+			devices: []*Device{
+				newTopologyDevice("10.0.0.1", "J5", "rack-1", ""),
+				newTopologyDevice("10.0.0.2", "J5", "rack-1", ""),
+			},
+			available:   []string{"10.0.0.1", "10.0.0.2"},
+			mustInclude: []string{"10.0.0.9", "10.0.0.2"},
+			size:        2,
+			want:        []string{"10.0.0.9", "10.0.0.2"},
+		},
+		{
+			name: "unknown must include filled up",
+			devices: []*Device{
+				newTopologyDevice("10.0.0.1", "J5", "rack-1", ""),
+				newTopologyDevice("10.0.0.2", "J5", "rack-2", ""),
+				newTopologyDevice("10.0.0.3", "J5", "rack-2", ""),
+			},
+			available:   []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+			mustInclude: []string{"10.0.0.9"},
+			size:        3,
+			want:        []string{"10.0.0.9", "10.0.0.2", "10.0.0.3"},
+		},
+		{
+			name: "location affinity",
+			devices: []*Device{
+				newTopologyDevice("10.0.0.1", "J5", "rack-1", ""),
+				newTopologyDevice("10.0.0.2", "J5", "rack-2", ""),
+				newTopologyDevice("10.0.0.9", "J5", "rack-1", ""),
+			},
+			available:   []string{"10.0.0.2", "10.0.0.9"},
+			mustInclude: []string{"10.0.0.1"},
+			size:        2,
+			want:        []string{"10.0.0.1", "10.0.0.9"},
+		},
+		{
+			name: "shared tags",
+			devices: []*Device{
+				newTopologyDevice("10.0.0.1", "", "", "camera,lab"),
+				newTopologyDevice("10.0.0.2", "", "", "lidar"),
+				newTopologyDevice("10.0.0.3", "", "", "lab"),
+				newTopologyDevice("10.0.0.9", "", "", "lab, camera"),
+			},
+			available:   []string{"10.0.0.2", "10.0.0.3", "10.0.0.9"},
+			mustInclude: []string{"10.0.0.1"},
+			size:        2,
+			want:        []string{"10.0.0.1", "10.0.0.9"},
+		},
+		{
+			name: "location outweighs tags",
+			devices: []*Device{
+				newTopologyDevice("10.0.0.1", "J5", "rack-1", "camera"),
+				newTopologyDevice("10.0.0.2", "J5", "rack-2", "camera"),
+				newTopologyDevice("10.0.0.3", "J5", "rack-1", ""),
+			},
+			available:   []string{"10.0.0.2", "10.0.0.3"},
+			mustInclude: []string{"10.0.0.1"},
+			size:        2,
+			want:        []string{"10.0.0.1", "10.0.0.3"},
+		},
+		{
+			name: "smallest fitting set",
+			devices: []*Device{
+				newTopologyDevice("10.0.0.1", "J5", "rack-1", ""),
+				newTopologyDevice("10.0.0.2", "J5", "rack-1", ""),
+				newTopologyDevice("10.0.0.3", "J5", "rack-1", ""),
+				newTopologyDevice("10.0.1.1", "J5", "rack-2", ""),
+				newTopologyDevice("10.0.1.2", "J5", "rack-2", ""),
+			},
+			available: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.1.1", "10.0.1.2"},
+			size:      2,
+			want:      []string{"10.0.1.1", "10.0.1.2"},
+		},
+		{
+			name: "composed 4J5 set",
+			devices: []*Device{
+				newTopologyDevice("10.0.0.1", "4J5", "rack-1", "camera"),
+				newTopologyDevice("10.0.0.2", "4J5", "rack-1", ""),
+				newTopologyDevice("10.0.1.1", "4J5", "rack-2", "camera"),
+				newTopologyDevice("10.0.1.2", "4J5", "rack-2", ""),
+				newTopologyDevice("10.0.1.3", "4J5", "rack-2", ""),
+				newTopologyDevice("10.0.1.4", "4J5", "rack-2", ""),
+				newTopologyDevice("10.0.2.1", "4J5", "rack-3", ""),
+				newTopologyDevice("10.0.2.2", "4J5", "rack-3", ""),
+				newTopologyDevice("10.0.2.3", "4J5", "rack-3", ""),
+				newTopologyDevice("10.0.2.4", "4J5", "rack-3", ""),
+				newTopologyDevice("10.0.2.5", "4J5", "rack-3", ""),
+			},
+			available: []string{"10.0.0.1", "10.0.0.2", "10.0.1.1", "10.0.1.2", "10.0.1.3", "10.0.1.4",
+				"10.0.2.1", "10.0.2.2", "10.0.2.3", "10.0.2.4", "10.0.2.5"},
+			size:     4,
+			composed: true,
+			want:     []string{"10.0.1.1", "10.0.1.2", "10.0.1.3", "10.0.1.4"},
+		},
+		{
+			name: "composed set of must include",
+			devices: []*Device{
+				newTopologyDevice("10.0.0.1", "4J5", "rack-1", "camera"),
+				newTopologyDevice("10.0.1.1", "4J5", "rack-2", "camera"),
+				newTopologyDevice("10.0.1.2", "4J5", "rack-2", ""),
+			},
+			available:   []string{"10.0.0.1", "10.0.1.2"},
+			mustInclude: []string{"10.0.1.1"},
+			size:        2,
+			composed:    true,
+			want:        []string{"10.0.1.1", "10.0.1.2"},
+		},
+		{
+			name: "size larger than available",
+			devices: []*Device{
+				newTopologyDevice("10.0.0.1", "J5", "rack-1", ""),
+				newTopologyDevice("10.0.0.2", "J5", "rack-2", ""),
+				newTopologyDevice("10.0.0.3", "J5", "rack-2", ""),
+			},
+			available: []string{"10.0.0.3", "10.0.0.1"},
+			size:      3,
+			want:      []string{"10.0.0.1", "10.0.0.3"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.want, preferredDevices(tc.devices, tc.available, tc.mustInclude, tc.size, tc.composed))
+		})
+	}
+}
+
+func TestBestFitSet(t *testing.T) {
+	devices := []*Device{
+		newTopologyDevice("10.0.0.1", "J5", "rack-1", ""),
+		newTopologyDevice("10.0.0.2", "J5", "rack-1", ""),
+		newTopologyDevice("10.0.0.3", "J5", "rack-1", ""),
+		newTopologyDevice("10.0.1.1", "J5", "rack-2", ""),
+		newTopologyDevice("10.0.2.1", "X3", "rack-1", ""),
+		newTopologyDevice("10.0.2.2", "X3", "rack-1", ""),
+	}
+
+	for _, tc := range []struct {
+		need int
+		want []string
+	}{
+		{1, []string{"10.0.1.1"}},
+		{2, []string{"10.0.2.1", "10.0.2.2"}},
+		{3, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+		// no set is big enough, the largest one is taken
+		{5, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+	} {
+		var ids []string
+		for _, d := range bestFitSet(devices, tc.need) {
+			ids = append(ids, d.ID)
+		}
+		require.Equal(t, tc.want, ids, "need %d", tc.need)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"carizon-device-plugin/conf"
+)
+
+// resource manager backends
+const (
+	backendCMDB = "cmdb"
+	backendFile = "file"
+)
+
+// ResourceManagerFactory creates the ResourceManager of a resource
+type ResourceManagerFactory func(resource conf.Resource) (ResourceManager, error)
+
+var (
+	backendsLock sync.RWMutex
+	backends     = map[string]ResourceManagerFactory{
+		backendCMDB: func(resource conf.Resource) (ResourceManager, error) {
+			return NewCarizonDeviceManager(resource), nil
+		},
+		backendFile: func(resource conf.Resource) (ResourceManager, error) {
+			return NewFileDeviceManager(resource), nil
+		},
+	}
+)
+
+// RegisterBackend registers a ResourceManager factory for the backend
+func RegisterBackend(backend string, factory ResourceManagerFactory) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	backends[backend] = factory
+}
+
+// NewResourceManager returns the ResourceManager of the backend configured for
+// the resource, cmdb by default
+func NewResourceManager(resource conf.Resource) (ResourceManager, error) {
+	backend := resource.Backend
+	if backend == "" {
+		backend = backendCMDB
+	}
+
+	backendsLock.RLock()
+	factory, ok := backends[backend]
+	backendsLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %s of resource %s", backend, resource.ResourceName)
+	}
+	return factory(resource)
+}
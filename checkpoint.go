@@ -2,24 +2,61 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"sort"
 
 	"carizon-device-plugin/pkg/logger"
 )
 
-const (
-	checkPointfile = "/var/lib/kubelet/device-plugins/kubelet_internal_checkpoint"
-)
+// checkPointfile is the device manager checkpoint of kubelet
+var checkPointfile = "/var/lib/kubelet/device-plugins/kubelet_internal_checkpoint"
 
 // PodDevicesEntry devices info map
 type PodDevicesEntry struct {
 	PodUID        string
 	ContainerName string
 	ResourceName  string
-	DeviceIDs     []string
+	DeviceIDs     checkpointDeviceIDs
 	AllocResp     []byte
 }
 
+// checkpointDeviceIDs are the devices of a checkpoint entry. Kubelet 1.20+
+// writes them per NUMA node, older kubelets as a list.
+type checkpointDeviceIDs []string
+
+// UnmarshalJSON implements json.Unmarshaler, the devices of all the NUMA nodes
+// are flattened in the order of the nodes, a device of several nodes only once
+func (ids *checkpointDeviceIDs) UnmarshalJSON(data []byte) error {
+	var list []string
+	if err := json.Unmarshal(data, &list); err == nil {
+		*ids = list
+		return nil
+	}
+
+	var perNUMA map[int64][]string
+	if err := json.Unmarshal(data, &perNUMA); err != nil {
+		return fmt.Errorf("device ids are neither a list nor per numa node: %s", string(data))
+	}
+	nodes := make([]int64, 0, len(perNUMA))
+	for node := range perNUMA {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i] < nodes[j] })
+
+	seen := make(map[string]bool)
+	*ids = checkpointDeviceIDs{}
+	for _, node := range nodes {
+		for _, id := range perNUMA[node] {
+			if !seen[id] {
+				seen[id] = true
+				*ids = append(*ids, id)
+			}
+		}
+	}
+	return nil
+}
+
 // checkpointData ...
 type checkpointData struct {
 	PodDeviceEntries  []PodDevicesEntry
@@ -36,6 +73,8 @@ type checkpointFileData struct {
 type checkpoint struct {
 	fileName   string
 	podEntires []PodDevicesEntry
+	// registeredDevices are the devices kubelet knows keyed by resource name
+	registeredDevices map[string][]string
 }
 
 // GetCheckpoint get checkpoint
@@ -70,23 +109,41 @@ func (cp *checkpoint) getPodEntries() error {
 	}
 
 	cp.podEntires = cpd.Data.PodDeviceEntries
+	cp.registeredDevices = cpd.Data.RegisteredDevices
 	return nil
 }
 
+// GetPodResources groups the checkpoint entries by pod and container, the
+// checkpoint only knows the pods by their UID
+func (cp *checkpoint) GetPodResources() ([]PodResources, error) {
+	pods := []PodResources{}
+	index := make(map[string]int)
+	for _, entry := range cp.podEntires {
+		i, ok := index[entry.PodUID]
+		if !ok {
+			i = len(pods)
+			index[entry.PodUID] = i
+			pods = append(pods, PodResources{UID: entry.PodUID, Containers: []ContainerResources{}})
+		}
+		container := pods[i].container(entry.ContainerName)
+		container.Devices = append(container.Devices, ContainerDevices{ResourceName: entry.ResourceName, DeviceIDs: []string(entry.DeviceIDs)})
+	}
+	return pods, nil
+}
+
 // GetPodResourceMap ...
 func (cp *checkpoint) GetPodResourceMap() (map[string]*ResourceInfo, error) {
-	resourceMap := make(map[string]*ResourceInfo)
-
-	for _, pod := range cp.podEntires {
-		entry, ok := resourceMap[pod.ResourceName]
-		if ok {
-			// already exists; append to it
-			entry.DeviceIDs = append(entry.DeviceIDs, pod.DeviceIDs...)
-		} else {
-			// new entry
-			resourceMap[pod.ResourceName] = &ResourceInfo{DeviceIDs: pod.DeviceIDs}
-		}
+	pods, err := cp.GetPodResources()
+	if err != nil {
+		return nil, err
 	}
+	return podResourceMap(pods), nil
+}
 
-	return resourceMap, nil
+// GetAllocatableDevices returns the devices registered in the checkpoint
+func (cp *checkpoint) GetAllocatableDevices() (map[string][]string, error) {
+	if cp.registeredDevices == nil {
+		return nil, errAllocatableUnavailable
+	}
+	return cp.registeredDevices, nil
 }
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+
+	"carizon-device-plugin/pkg/fakecmdb"
+)
+
+// newFakeCMDB starts a fake cmdb and points the plugin to it for the test
+func newFakeCMDB(t *testing.T) *fakecmdb.Server {
+	s := fakecmdb.NewServer()
+	prev := CmdbServer
+	CmdbServer = s.URL
+	t.Cleanup(func() {
+		CmdbServer = prev
+		s.Close()
+	})
+	return s
+}
+
+func newTestDevice(uuid int64, ip string) *Device {
+	return buildDevice(&externalDevice{UUID: int(uuid), IP: ip})
+}
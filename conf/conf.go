@@ -1,21 +1,124 @@
 package conf
 
-var Conf Config
+import (
+	"sync"
+	"time"
+)
+
+var (
+	lock    sync.RWMutex
+	current Config
+)
+
+// Get 返回当前加载的配置，配置变更时整体替换而不会原地修改，调用方不能修改返回配置中的切片和map
+func Get() Config {
+	lock.RLock()
+	defer lock.RUnlock()
+	return current
+}
+
+// Set 替换当前加载的配置
+func Set(c Config) {
+	lock.Lock()
+	defer lock.Unlock()
+	current = c
+}
 
 // Filter 定义了过滤条件，这里使用map[string]interface{}是因为基于 YAML 数据中“id”的条件比较特殊
 type Filter struct {
-	NodeName string                 `yaml:"nodename"`
-	ID       map[string]interface{} `yaml:"id"`
+	// NodeName 设备绑定的节点名称，默认为本节点
+	NodeName string `yaml:"nodename"`
+	// ID 设备实例ID的条件，key为操作符，如 {"$in": [318, 319]}、{"$gte": 300}
+	ID map[string]interface{} `yaml:"id"`
 }
 
 // Resource 描述了一种资源和它的查询条件
 type Resource struct {
-	ResourceName string     `yaml:"resource_name"`
-	Filter       Filter     `yaml:"filter,omitempty"`
-	Projection   []string   `yaml:"projection"`
-	SubResource  []Resource `yaml:"sub_resource,omitempty"`
+	// ResourceName 资源名称，同时也是设备在CMDB中的模型ID
+	ResourceName string `yaml:"resource_name"`
+	// Backend 设备来源：cmdb（默认）或 file
+	Backend string `yaml:"backend,omitempty"`
+	// File file来源的设备清单文件，yaml或json格式，默认为/etc/carizon-device-plugin/<resource_name>.yaml
+	File   string `yaml:"file,omitempty"`
+	Filter Filter `yaml:"filter,omitempty"`
+	// Projection 查询设备实例时返回的字段，为空时返回全部字段
+	Projection []string `yaml:"projection"`
+	// SubResource 子资源，每个子资源作为单独的扩展资源上报，resource_name为完整的资源名称如J5-camera
+	// 子资源设备与父资源中IP相同的设备互斥，其中一个被分配后另一个不可用
+	SubResource []Resource `yaml:"sub_resource,omitempty"`
+	// PreStartRequired 容器启动前在CMDB中重新校验并租用分配的设备
+	PreStartRequired bool `yaml:"pre_start_required,omitempty"`
+	// Allocation 分配设备时注入容器的模板
+	Allocation Allocation `yaml:"allocation,omitempty"`
+	// HealthCheck 设备健康检查配置
+	HealthCheck HealthCheck `yaml:"health_check,omitempty"`
+	// Probe 设备IP网络存活探测配置
+	Probe Probe `yaml:"probe,omitempty"`
+	// DiscoveryInterval 重新发现设备的间隔，默认5m，小于0时不重新发现
+	DiscoveryInterval time.Duration `yaml:"discovery_interval,omitempty"`
+}
+
+// HealthCheck 描述了基于CMDB的设备健康检查
+type HealthCheck struct {
+	// Interval 检查间隔，默认10s
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// StaleThreshold 设备last_alive_time超过该时长未更新则认为设备离线，默认5m，小于0时不检查
+	StaleThreshold time.Duration `yaml:"stale_threshold,omitempty"`
+	// UseHealthyAPI 使用CMDB的 device/{id}/healthy 接口代替实例属性判断设备健康
+	UseHealthyAPI bool `yaml:"use_healthy_api,omitempty"`
+}
+
+// Probe 描述了对设备IP的主动探测，和CMDB健康检查的结果共同决定设备是否健康
+// 探测配置无效（如tcp探测未配置端口）的资源不会被加载
+type Probe struct {
+	// Type 探测方式：tcp、udp、http，为空时不探测
+	Type string `yaml:"type,omitempty"`
+	// Port 探测端口，udp默认7，http默认80
+	Port int `yaml:"port,omitempty"`
+	// Path http探测的路径，默认/
+	Path string `yaml:"path,omitempty"`
+	// Payload udp探测发送的内容
+	Payload string `yaml:"payload,omitempty"`
+	// Timeout 单次探测超时，默认3s
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// FailureThreshold 连续探测失败多少次认为设备不健康，默认3
+	FailureThreshold int `yaml:"failure_threshold,omitempty"`
+}
+
+// Allocation 描述了分配设备时注入容器的设备节点、挂载和注解
+// 模板中的占位符会按每个分配的设备展开：{ip} 设备IP、{uuid} 设备ID、{index} 设备在请求中的序号、{ips} 所有分配的设备IP
+// 展开后容器路径相同而主机路径或选项不同的设备节点或挂载会使分配失败
+type Allocation struct {
+	Devices     []DeviceSpec      `yaml:"devices,omitempty"`
+	Mounts      []Mount           `yaml:"mounts,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+// DeviceSpec 描述了挂载到容器中的主机设备节点
+type DeviceSpec struct {
+	ContainerPath string `yaml:"container_path"`
+	HostPath      string `yaml:"host_path"`
+	// Permissions cgroups权限，r、w、m的组合，默认rw
+	Permissions string `yaml:"permissions,omitempty"`
+}
+
+// Mount 描述了挂载到容器中的主机目录或文件
+type Mount struct {
+	ContainerPath string `yaml:"container_path"`
+	HostPath      string `yaml:"host_path"`
+	ReadOnly      bool   `yaml:"read_only,omitempty"`
 }
 
 type Config struct {
 	ResourceDevices []Resource `yaml:"resource_device_plugin"`
+	// NodeFeatures 将设备信息发布为节点的标签和注解
+	NodeFeatures NodeFeatures `yaml:"node_features,omitempty"`
+}
+
+// NodeFeatures 描述了节点特征的发布，标签如 carizon.io/chip-type.J5=true，注解 carizon.io/device-inventory 为设备清单JSON
+type NodeFeatures struct {
+	// Enabled 是否发布节点特征，默认不发布
+	Enabled bool `yaml:"enabled,omitempty"`
+	// ResyncInterval 没有设备变化时重新发布的间隔，默认10m
+	ResyncInterval time.Duration `yaml:"resync_interval,omitempty"`
 }
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"carizon-device-plugin/conf"
+	httpclient "carizon-device-plugin/pkg/client"
+	"carizon-device-plugin/pkg/logger"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// maxRecentAllocations is the number of Allocate requests kept for debugging
+const maxRecentAllocations = 100
+
+// podResourcesSnapshot is the pod resources seen by the last refresh
+type podResourcesSnapshot struct {
+	sync.RWMutex
+	time      time.Time
+	pods      []PodResources
+	resources map[string]*ResourceInfo
+	// pending are the devices missing from the snapshot, released when they are
+	// missing from the next one as well
+	pending map[string][]string
+}
+
+// lastPodResources is the pod resources seen by the previous refresh
+var lastPodResources podResourcesSnapshot
+
+func (s *podResourcesSnapshot) get() map[string]*ResourceInfo {
+	s.RLock()
+	defer s.RUnlock()
+	return s.resources
+}
+
+func (s *podResourcesSnapshot) pendingRelease() map[string][]string {
+	s.RLock()
+	defer s.RUnlock()
+	return s.pending
+}
+
+func (s *podResourcesSnapshot) set(pods []PodResources, resources map[string]*ResourceInfo, pending map[string][]string) {
+	s.Lock()
+	defer s.Unlock()
+	s.time = time.Now()
+	s.pods = pods
+	s.resources = resources
+	s.pending = pending
+}
+
+// allocationRecord is an Allocate request served by a plugin
+type allocationRecord struct {
+	Time       time.Time  `json:"time"`
+	Resource   string     `json:"resource"`
+	Containers [][]string `json:"containers"`
+	Error      string     `json:"error,omitempty"`
+}
+
+var (
+	recentAllocationsLock sync.RWMutex
+	recentAllocations     []allocationRecord
+)
+
+func recordAllocation(resourceName string, reqs *pluginapi.AllocateRequest, err error) {
+	record := allocationRecord{Time: time.Now(), Resource: resourceName}
+	for _, req := range reqs.ContainerRequests {
+		record.Containers = append(record.Containers, req.DevicesIDs)
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	recentAllocationsLock.Lock()
+	defer recentAllocationsLock.Unlock()
+	recentAllocations = append(recentAllocations, record)
+	if len(recentAllocations) > maxRecentAllocations {
+		recentAllocations = recentAllocations[len(recentAllocations)-maxRecentAllocations:]
+	}
+}
+
+// debugDevice is a cached device as shown by the debug api
+type debugDevice struct {
+	ID       string `json:"id"`
+	IP       string `json:"ip"`
+	UUID     int    `json:"uuid"`
+	ChipType string `json:"chip_type,omitempty"`
+	Location string `json:"location,omitempty"`
+	Tags     string `json:"tags,omitempty"`
+	Health   string `json:"health"`
+	Taken    bool   `json:"taken,omitempty"`
+	Retired  bool   `json:"retired,omitempty"`
+}
+
+// debugPlugin is a supervised plugin as shown by the debug api
+type debugPlugin struct {
+	PluginStatus
+	Devices []debugDevice `json:"devices"`
+}
+
+// debugDevices returns the cached devices with their health, taken and retired flags
+func (h *CarizonDevicePlugin) debugDevices() []debugDevice {
+	h.RLock()
+	defer h.RUnlock()
+
+	devices := make([]debugDevice, 0, len(h.cachedDevices))
+	for _, d := range h.cachedDevices {
+		_, taken := h.taken[d.ID]
+		devices = append(devices, debugDevice{
+			ID:       d.ID,
+			IP:       d.IP,
+			UUID:     d.UUID,
+			ChipType: d.ChipType,
+			Location: d.Location,
+			Tags:     d.Tags,
+			Health:   h.healthState[d.ID],
+			Taken:    taken,
+			Retired:  h.retired[d.ID],
+		})
+	}
+	return devices
+}
+
+// registerDebugHandlers registers the debug api:
+//
+//	/debug/plugins       the plugins with their state and cached devices
+//	/debug/podresources  the last pod resources snapshot, per pod and per resource, and the devices pending release
+//	/debug/cmdb          the recent cmdb requests and responses
+//	/debug/config        the config currently loaded
+//	/debug/allocations   the recent Allocate requests
+func registerDebugHandlers(mux *http.ServeMux, supervisor *PluginSupervisor) {
+	mux.HandleFunc("/debug/plugins", func(w http.ResponseWriter, r *http.Request) {
+		status := make(map[string]PluginStatus)
+		for _, s := range supervisor.Status() {
+			status[s.ResourceName] = s
+		}
+
+		plugins := []debugPlugin{}
+		for _, p := range supervisor.Plugins() {
+			plugins = append(plugins, debugPlugin{PluginStatus: status[p.resourceName], Devices: p.debugDevices()})
+		}
+		writeJSON(w, plugins)
+	})
+
+	mux.HandleFunc("/debug/podresources", func(w http.ResponseWriter, r *http.Request) {
+		lastPodResources.RLock()
+		defer lastPodResources.RUnlock()
+		writeJSON(w, map[string]interface{}{
+			"time":      lastPodResources.time,
+			"pods":      lastPodResources.pods,
+			"resources": lastPodResources.resources,
+			"pending":   lastPodResources.pending,
+		})
+	})
+
+	mux.HandleFunc("/debug/cmdb", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, httpclient.RecentExchanges())
+	})
+
+	mux.HandleFunc("/debug/config", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, conf.Get())
+	})
+
+	mux.HandleFunc("/debug/allocations", func(w http.ResponseWriter, r *http.Request) {
+		recentAllocationsLock.RLock()
+		defer recentAllocationsLock.RUnlock()
+		writeJSON(w, append([]allocationRecord{}, recentAllocations...))
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		logger.Wrapper.Errorf("[debug] Write response error: %s", err.Error())
+	}
+}
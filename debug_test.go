@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// getDebug serves the debug api request and decodes the response into v
+func getDebug(t *testing.T, supervisor *PluginSupervisor, path string, v interface{}) {
+	mux := http.NewServeMux()
+	registerDebugHandlers(mux, supervisor)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), v))
+}
+
+func TestDebugPlugins(t *testing.T) {
+	k := newFakeKubelet(t)
+	m := newStubManager("10.0.0.1", "10.0.0.2")
+	p := newTestPlugin(k, m)
+	s := newTestSupervisor(t, p)
+	updates := k.watch(t, k.connect(t, k.waitRegistered(t)))
+	nextUpdate(t, updates)
+	m.flip(t, "10.0.0.2", false)
+	nextUpdate(t, updates)
+	p.addTaken([]string{"10.0.0.1"})
+
+	var plugins []debugPlugin
+	getDebug(t, s, "/debug/plugins", &plugins)
+	require.Len(t, plugins, 1)
+	require.Equal(t, testResourceName, plugins[0].ResourceName)
+	require.Equal(t, PluginRunning, plugins[0].State)
+	require.Equal(t, []debugDevice{
+		{ID: "10.0.0.1", IP: "10.0.0.1", UUID: 1, Health: pluginapi.Healthy, Taken: true},
+		{ID: "10.0.0.2", IP: "10.0.0.2", UUID: 2, Health: pluginapi.Unhealthy},
+	}, plugins[0].Devices)
+}
+
+func TestDebugPodResources(t *testing.T) {
+	lastPodResources.RLock()
+	prevPods, prevResources, prevPending := lastPodResources.pods, lastPodResources.resources, lastPodResources.pending
+	lastPodResources.RUnlock()
+	defer lastPodResources.set(prevPods, prevResources, prevPending)
+
+	owner := DeviceOwner{PodUID: "uid-1", PodName: "pod-1", PodNamespace: "default", ContainerName: "main"}
+	lastPodResources.set(
+		[]PodResources{{Name: "pod-1", Namespace: "default", UID: "uid-1", Containers: []ContainerResources{
+			{Name: "main", Devices: []ContainerDevices{{ResourceName: testResourceName, DeviceIDs: []string{"10.0.0.1"}}}},
+		}}},
+		map[string]*ResourceInfo{testResourceName: {DeviceIDs: []string{"10.0.0.1"}, Owners: map[string]DeviceOwner{"10.0.0.1": owner}}},
+		map[string][]string{testResourceName: {"10.0.0.2"}},
+	)
+
+	var snapshot struct {
+		Pods      []PodResources           `json:"pods"`
+		Resources map[string]*ResourceInfo `json:"resources"`
+		Pending   map[string][]string      `json:"pending"`
+	}
+	getDebug(t, NewPluginSupervisor(), "/debug/podresources", &snapshot)
+	require.Equal(t, "pod-1", snapshot.Pods[0].Name)
+	require.Equal(t, []string{"10.0.0.1"}, snapshot.Pods[0].Containers[0].Devices[0].DeviceIDs)
+	require.Equal(t, []string{"10.0.0.1"}, snapshot.Resources[testResourceName].DeviceIDs)
+	require.Equal(t, owner, snapshot.Resources[testResourceName].Owners["10.0.0.1"])
+	require.Equal(t, map[string][]string{testResourceName: {"10.0.0.2"}}, snapshot.Pending)
+}
+
+func TestDebugAllocations(t *testing.T) {
+	recentAllocationsLock.Lock()
+	prev := recentAllocations
+	recentAllocations = nil
+	recentAllocationsLock.Unlock()
+	defer func() {
+		recentAllocationsLock.Lock()
+		recentAllocations = prev
+		recentAllocationsLock.Unlock()
+	}()
+
+	// only the last maxRecentAllocations requests are kept
+	total := maxRecentAllocations + 5
+	for i := 0; i < total; i++ {
+		var err error
+		if i == total-1 {
+			err = errors.New("device is not healthy")
+		}
+		recordAllocation(testResourceName, &pluginapi.AllocateRequest{ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{fmt.Sprintf("10.0.0.%d", i)}},
+		}}, err)
+	}
+
+	var records []allocationRecord
+	getDebug(t, NewPluginSupervisor(), "/debug/allocations", &records)
+	require.Len(t, records, maxRecentAllocations)
+	require.Equal(t, [][]string{{"10.0.0.5"}}, records[0].Containers)
+	require.Empty(t, records[0].Error)
+	last := records[len(records)-1]
+	require.Equal(t, testResourceName, last.Resource)
+	require.Equal(t, [][]string{{fmt.Sprintf("10.0.0.%d", total-1)}}, last.Containers)
+	require.Equal(t, "device is not healthy", last.Error)
+}
@@ -2,12 +2,15 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
+	"carizon-device-plugin/conf"
 	"carizon-device-plugin/metadata"
 	"carizon-device-plugin/pkg/logger"
 	"carizon-device-plugin/pkg/mapstr"
@@ -21,15 +24,44 @@ const (
 	CarizonPcieFlagEnv       = "PCIE_FLAG"
 	healthCheckEnv           = "DEVICE_HEALTH_CHECK"
 	cmdbServerEnv            = "BK_CMDB_CHART_PORT"
+	nodeNameEnv              = "NODE_NAME"
 	resourceDomain           = "carizon/"
 	resourceCount            = resourceDomain + CarizonDevicePcie
-	healthCheckInterval      = 10
+	healthCheckInterval      = 10 * time.Second
+	healthStaleThreshold     = 5 * time.Minute
 	cmdbAPI                  = "/api/v3/"
 	findInstassociationAPI   = cmdbAPI + "find/instassociation"
 	searchObjectInstsAPI     = cmdbAPI + "search/instances/object/%s"
 	checkHealthAPI           = cmdbAPI + "device/%d/healthy"
-	batchUpdateInstsAPI      = cmdbAPI + "/updatemany/instance/object/%s"
+	batchUpdateInstsAPI      = cmdbAPI + "updatemany/instance/object/%s"
 	getAllocateDeviceInfoAPI = cmdbAPI + "list/devices"
+	composedChipType         = "4J5"
+)
+
+// host object of the node in cmdb
+const (
+	hostObjectID  = "host"
+	hostFieldName = "bk_inst_name"
+)
+
+// device instance fields in cmdb
+const (
+	deviceFieldInstID       = "bk_inst_id"
+	deviceFieldIP           = "ip"
+	deviceFieldStatus       = "status"
+	deviceFieldLastAlive    = "last_alive_time"
+	deviceFieldChipType     = "chip_type"
+	deviceFieldLocation     = "location"
+	deviceFieldTags         = "tags"
+	deviceFieldSysVersion   = "system_version"
+	deviceFieldIsReserved   = "is_reserved"
+	deviceFieldReservedNode = "reserved_node"
+	deviceFieldReservedPod  = "reserved_pod_uid"
+	deviceFieldReservedTime = "reserved_time"
+	// owner of the reserved device
+	deviceFieldReservedPodName      = "reserved_pod_name"
+	deviceFieldReservedPodNamespace = "reserved_pod_namespace"
+	deviceFieldReservedContainer    = "reserved_container"
 )
 
 // DeviceOffline represents offline status of the deivce
@@ -38,17 +70,24 @@ var DeviceOffline = 1
 // CmdbServer address of the cmdb server
 var CmdbServer = getCmdbServerAddr()
 
+// NodeName name of the node the plugin runs on
+var NodeName = getNodeName()
+
 // ResourceManager interface of the device resource maanger
 type ResourceManager interface {
-	Devices() []*Device
+	Devices() ([]*Device, error)
 	CheckHealth(stop <-chan interface{}, devices []*Device, healthy, unhealthy chan<- *Device)
 	GetAllocateDevicesInfo(deviceIPs []string) (info *[]PCIeAddressInfo, err error)
-	Allocate(deviceIPs []string)
+	Allocate(deviceIPs []string, owner Reservation) []ReservationResult
+	Lease(deviceIPs []string) error
+	Release(deviceIPs []string)
+	Reserved() ([]string, error)
 }
 
 // CarizonDeviceManager horzion device manager
 type CarizonDeviceManager struct {
 	deviceType string
+	resource   conf.Resource
 }
 
 func getCmdbServerAddr() string {
@@ -60,50 +99,162 @@ func getCmdbServerAddr() string {
 	return server
 }
 
+func getNodeName() string {
+	if nodeName := strings.TrimSpace(os.Getenv(nodeNameEnv)); nodeName != "" {
+		return nodeName
+	}
+	nodeName, err := os.Hostname()
+	if err != nil {
+		log.Printf("Error. Fail to get hostname: %s", err.Error())
+	}
+	return nodeName
+}
+
 // NewCarizonDeviceManager returns a new instance of CarizonDeviceManager
-func NewCarizonDeviceManager(deviceType string) *CarizonDeviceManager {
-	return &CarizonDeviceManager{deviceType: deviceType}
+func NewCarizonDeviceManager(resource conf.Resource) *CarizonDeviceManager {
+	return &CarizonDeviceManager{deviceType: resource.ResourceName, resource: resource}
 }
 
 // Devices returns all devices
-func (c *CarizonDeviceManager) Devices() []*Device {
+func (c *CarizonDeviceManager) Devices() ([]*Device, error) {
 	var devs []*Device
 
-	devices, err := getDevices(c.deviceType)
-	checkErr(err)
+	devices, err := getDevices(c.resource)
+	if err != nil {
+		return nil, err
+	}
 
 	for _, d := range devices {
 		devs = append(devs, buildDevice(d))
 	}
 
-	return devs
+	return devs, nil
 }
 
-// Allocate the device to job,then other job can not use the device
-func (h *CarizonDeviceManager) Allocate(deviceIPs []string) {
-	logger.Wrapper.Infof("Allocate deviceIPs: %+v", deviceIPs)
+// Allocate reserves the devices in cmdb for the owner, so that other jobs can not
+// use them. Devices missing in cmdb or reserved by another node are left untouched.
+func (h *CarizonDeviceManager) Allocate(deviceIPs []string, owner Reservation) []ReservationResult {
+	logger.Wrapper.Infof("Allocate deviceIPs: %+v, owner: %+v", deviceIPs, owner)
 
-	//SearchAssociationInsts
-	option := metadata.OpCondition{
-		Update: []metadata.UpdateCondition{{InstID: 9527, InstInfo: map[string]interface{}{}}},
+	data := map[string]interface{}{
+		deviceFieldIsReserved:   1,
+		deviceFieldReservedNode: owner.Node,
+		deviceFieldReservedTime: time.Now().Format(cmdbTimeLayout),
 	}
+	// the pod is unknown when kubelet allocates, keep the one recorded by the reconciliation.
+	// The reconciliation overwrites every field, the new owner may lack the uid of the old one.
+	for field, value := range ownerFields(owner.DeviceOwner) {
+		if value != "" || !owner.KeepOwner {
+			data[field] = value
+		}
+	}
+	results := updateReservations(h.deviceType, deviceIPs, owner.Node, data)
+	if err := reservationError(results); err != nil {
+		logger.Wrapper.Errorf("Failed to allocate %s devices: %v", h.deviceType, err)
+	}
+	return results
+}
 
-	resp := new(metadata.SearchAssociationInstResult)
-	err := CmdbApiClient.DoPut(context.Background(), CmdbServer+fmt.Sprintf(batchUpdateInstsAPI, ""), map[string]string{}, option).Into(resp)
+// Release the devices of terminated jobs,then other job can use the device again
+func (h *CarizonDeviceManager) Release(deviceIPs []string) {
+	logger.Wrapper.Infof("Release deviceIPs: %+v", deviceIPs)
+
+	data := map[string]interface{}{
+		deviceFieldIsReserved:   0,
+		deviceFieldReservedNode: "",
+		deviceFieldReservedTime: "",
+	}
+	for field := range ownerFields(DeviceOwner{}) {
+		data[field] = ""
+	}
+	// never take back a device which has been reserved by another node in the meantime
+	results := updateReservations(h.deviceType, deviceIPs, NodeName, data)
+	if err := reservationError(results); err != nil {
+		logger.Wrapper.Errorf("Failed to release %s devices: %v", h.deviceType, err)
+	}
+}
+
+// Reserved returns the devices reserved by this node in CMDB
+func (h *CarizonDeviceManager) Reserved() ([]string, error) {
+	insts, err := searchInsts(h.deviceType, []metadata.AtomRule{
+		{Field: deviceFieldIsReserved, Operator: metadata.Operator("equal"), Value: 1},
+		{Field: deviceFieldReservedNode, Operator: metadata.Operator("equal"), Value: NodeName},
+	}, []string{deviceFieldIP})
+	if err != nil {
+		logger.Wrapper.Errorf("Error. Failed to query %s devices reserved by node %s. %v", h.deviceType, NodeName, err)
+		return nil, err
+	}
+
+	ips := make([]string, 0, len(insts))
+	for _, inst := range insts {
+		if ip, _ := inst.String(deviceFieldIP); ip != "" {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
+
+// Lease re-checks the devices in CMDB before the container starts and reserves them
+// for this node. It fails if a device is missing, offline or reserved by another node.
+func (h *CarizonDeviceManager) Lease(deviceIPs []string) error {
+	insts, err := searchDeviceInsts(h.deviceType, deviceIPs)
 	if err != nil {
-		logger.Wrapper.Errorf("Failed to allocate device.Err: %+v,DeviceIP: %s", err, deviceIPs)
+		return err
 	}
+
+	found := make(map[string]mapstr.MapStr, len(insts))
+	for _, inst := range insts {
+		ip, _ := inst.String(deviceFieldIP)
+		found[ip] = inst
+	}
+
+	for _, ip := range deviceIPs {
+		inst, ok := found[ip]
+		if !ok {
+			return fmt.Errorf("device %s not found in cmdb", ip)
+		}
+		if status, _ := inst.Int64(deviceFieldStatus); status == int64(DeviceOffline) {
+			return fmt.Errorf("device %s is offline", ip)
+		}
+		if owner, ok := reservedByOther(inst, NodeName); ok {
+			return fmt.Errorf("device %s is reserved by node %s", ip, owner)
+		}
+	}
+
+	return reservationError(h.Allocate(deviceIPs, Reservation{Node: NodeName, KeepOwner: true}))
 }
 
-// GetAllocateDevicesInfo is get device ip and how many pcie occupied
-func (h *CarizonDeviceManager) GetAllocateDevicesInfo(deviceIPs []string) (info *[]PCIeAddressInfo, err error) {
-	//data := map[string][]string{"ips": deviceIPs}
-	//resp, err := CmdbApiClient.DoPost(context.Background(), CmdbServer+getAllocateDeviceInfoAPI, data, data)
+// GetAllocateDevicesInfo returns the pcie info of the devices from cmdb. Devices
+// without pcie info are left out, the caller reports them as missing.
+func (h *CarizonDeviceManager) GetAllocateDevicesInfo(deviceIPs []string) (*[]PCIeAddressInfo, error) {
+	data := map[string][]string{"ips": deviceIPs}
+	resp := new(HTTPRetAllocateDevicesInfo)
+	err := CmdbApiClient.DoPost(context.Background(), CmdbServer+getAllocateDeviceInfoAPI, map[string]string{}, data).Into(resp)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Code != 0 {
+		return nil, fmt.Errorf("list devices %v error, code: %d, msg: %s", deviceIPs, resp.Code, resp.ErrMsg)
+	}
 
-	var result *HTTPRetAllocateDevicesInfo
+	requested := make(map[string]bool, len(deviceIPs))
+	for _, ip := range deviceIPs {
+		requested[ip] = true
+	}
+	info := make([]PCIeAddressInfo, 0, len(resp.Data))
+	for _, i := range resp.Data {
+		if requested[i.IP] && i.VNetIP != "" {
+			info = append(info, i)
+		}
+	}
+	logger.Wrapper.Infof("pcie info of %v: %+v", deviceIPs, info)
+	return &info, nil
+}
 
-	logger.Wrapper.Infof("result is %+v", result)
-	return &result.Data, nil
+// isComposedResource reports whether the resource is made up of composed chip
+// sets, e.g. 4J5, whose devices must be allocated together
+func isComposedResource(resourceName string) bool {
+	return strings.Contains(resourceName, composedChipType)
 }
 
 func buildDevice(d *externalDevice) *Device {
@@ -112,116 +263,312 @@ func buildDevice(d *externalDevice) *Device {
 	dev.ID = d.IP
 	dev.IP = d.IP
 	dev.UUID = d.UUID
+	dev.ChipType = d.ChipType
+	dev.SystemVersion = d.SystemVersion
+	dev.Location = d.Location
+	dev.Tags = d.Tags
 	dev.Health = pluginapi.Healthy
 	return &dev
 }
 
-// CheckHealth checks health of the devices
-func (h *CarizonDeviceManager) CheckHealth(stop <-chan interface{}, devices []*Device, healthy, unhealthy chan<- *Device) {
-	checkHealth(stop, devices, healthy, unhealthy)
-}
+func getDevices(resource conf.Resource) ([]*externalDevice, error) {
+	deviceType := resource.ResourceName
+	eDevices := []*externalDevice{}
+	nodeName := resource.Filter.NodeName
+	if nodeName == "" {
+		nodeName = NodeName
+	}
 
-func checkHealth(stop <-chan interface{}, devices []*Device, healthy, unhealthy chan<- *Device) {
-	healthCheck := strings.ToLower(os.Getenv(healthCheckEnv))
-	if healthCheck == "false" {
-		log.Printf("Disable device health checks")
-		return
+	log.Printf("Query %s devices on node: %s", deviceType, nodeName)
+
+	instIDs, err := getNodeDeviceInstIDs(nodeName, deviceType)
+	if err != nil {
+		logger.Wrapper.Errorf("Error. Failed to query %s bind devices on node %s. %v", deviceType, nodeName, err)
+		return nil, err
+	}
+	if len(instIDs) == 0 {
+		log.Printf("No %s devices bind to node: %s", deviceType, nodeName)
+		return eDevices, nil
 	}
 
-	for {
-		select {
-		case <-stop:
-			return
-		default:
-		}
+	rules := []metadata.AtomRule{{Field: deviceFieldInstID, Operator: metadata.Operator("in"), Value: instIDs}}
+	idRules, err := filterIDRules(resource.Filter.ID)
+	if err != nil {
+		logger.Wrapper.Errorf("Error. Invalid %s id filter %+v. %v", deviceType, resource.Filter.ID, err)
+		return nil, err
+	}
+	rules = append(rules, idRules...)
 
-		for _, d := range devices {
-			if !isDeviceHealthy(d.UUID) {
-				if d.Health == pluginapi.Healthy {
-					log.Printf("Device %s become unhealthy", d.IP)
-					unhealthy <- d
-				}
-			} else {
-				if d.Health == pluginapi.Unhealthy {
-					log.Printf("Device %s become healthy", d.IP)
-					healthy <- d
-				}
-			}
+	insts, err := searchInsts(deviceType, rules, deviceFields(resource.Projection))
+	if err != nil {
+		logger.Wrapper.Errorf("Error. Failed to query %s bind devices on node %s. %v", deviceType, nodeName, err)
+		return nil, err
+	}
+
+	for _, inst := range insts {
+		if status, err := inst.Int64(deviceFieldStatus); err == nil && status == int64(DeviceOffline) {
+			continue
+		}
+		eDevice, err := toExternalDevice(inst)
+		if err != nil {
+			logger.Wrapper.Errorf("Error. Invalid %s device %+v. %v", deviceType, inst, err)
+			continue
 		}
-		time.Sleep(healthCheckInterval * time.Second)
+		eDevices = append(eDevices, eDevice)
 	}
+
+	return eDevices, nil
 }
 
-func getDevices(deviceType string) ([]*externalDevice, error) {
-	objectID := "host"
-	eDevices := []*externalDevice{}
-	nodeName, err := os.Hostname()
+// getNodeDeviceInstIDs resolves the node instance by its name and returns the
+// instance IDs of the devices associated with it
+func getNodeDeviceInstIDs(nodeName, deviceType string) ([]int64, error) {
+	nodes, err := searchInsts(hostObjectID, []metadata.AtomRule{
+		{Field: hostFieldName, Operator: metadata.Operator("equal"), Value: nodeName},
+	}, []string{deviceFieldInstID})
+	if err != nil {
+		return nil, err
+	}
+	if len(nodes) == 0 {
+		log.Printf("Node %s not found in cmdb", nodeName)
+		return nil, nil
+	}
+	nodeID, err := nodes[0].Int64(deviceFieldInstID)
 	if err != nil {
-		log.Printf("Error. Fail to get hostname: %s", err.Error())
 		return nil, err
 	}
-
-	log.Printf("Query %s devices on node: %s", deviceType, nodeName)
 
 	//SearchAssociationInsts
 	option := &metadata.SearchAssociationInstRequest{
-		ObjID: objectID,
+		ObjID: hostObjectID,
 		Condition: mapstr.MapStr{
-			"bk_inst_id": nodeName,
-			"bk_obj_id":  objectID,
+			metadata.AssociationFieldObjectID:            hostObjectID,
+			deviceFieldInstID:                            nodeID,
+			metadata.AssociationFieldAssociationObjectID: deviceType,
 		},
 	}
 
 	resp := new(metadata.SearchAssociationInstResult)
 	err = CmdbApiClient.DoPost(context.Background(), CmdbServer+findInstassociationAPI, map[string]string{}, option).Into(resp)
 	if err != nil {
-		logger.Wrapper.Errorf("Error. Failed to query %s bind devices on node %s. %v", deviceType, nodeName, err)
-		return eDevices, nil
+		return nil, err
+	}
+
+	var instIDs []int64
+	for _, asst := range resp.Data {
+		if asst.ObjectID == hostObjectID && asst.InstID == nodeID {
+			instIDs = append(instIDs, asst.AsstInstID)
+		} else {
+			instIDs = append(instIDs, asst.InstID)
+		}
+	}
+	return instIDs, nil
+}
+
+// filterIDOperators maps the operators allowed in the id filter to cmdb operators
+var filterIDOperators = map[string]string{
+	"equal":            "equal",
+	"not_equal":        "not_equal",
+	"in":               "in",
+	"not_in":           "not_in",
+	"less":             "less",
+	"less_or_equal":    "less_or_equal",
+	"greater":          "greater",
+	"greater_or_equal": "greater_or_equal",
+	"eq":               "equal",
+	"ne":               "not_equal",
+	"nin":              "not_in",
+	"lt":               "less",
+	"lte":              "less_or_equal",
+	"gt":               "greater",
+	"gte":              "greater_or_equal",
+}
+
+// filterIDRules converts the id filter of the resource, e.g. {"$in": [318, 319]},
+// to cmdb rules on the device instance ID
+func filterIDRules(filter map[string]interface{}) ([]metadata.AtomRule, error) {
+	var ops []string
+	for op := range filter {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	var rules []metadata.AtomRule
+	for _, op := range ops {
+		operator, ok := filterIDOperators[strings.TrimPrefix(op, "$")]
+		if !ok {
+			return nil, fmt.Errorf("unsupported operator: %s", op)
+		}
+		rules = append(rules, metadata.AtomRule{Field: deviceFieldInstID, Operator: metadata.Operator(operator), Value: filter[op]})
+	}
+	return rules, nil
+}
+
+// deviceFields returns the fields to query, which always contain the fields
+// needed to build a device
+func deviceFields(projection []string) []string {
+	if len(projection) == 0 {
+		return []string{}
+	}
+
+	fields := append([]string{}, projection...)
+	for _, f := range []string{deviceFieldInstID, deviceFieldIP, deviceFieldStatus, deviceFieldChipType, deviceFieldLocation, deviceFieldTags, deviceFieldSysVersion} {
+		found := false
+		for _, p := range projection {
+			if p == f {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+func toExternalDevice(inst mapstr.MapStr) (*externalDevice, error) {
+	instID, err := inst.Int64(deviceFieldInstID)
+	if err != nil {
+		return nil, err
+	}
+	ip, _ := inst.String(deviceFieldIP)
+	if ip == "" {
+		return nil, fmt.Errorf("device %d has no ip", instID)
 	}
 
-	// for _, d := range resp.Data {
-	// 	if d.Status == int8(DeviceOffline) {
-	// 		continue
-	// 	}
-	// 	eDevice := externalDevice{}
-	// 	eDevice.UUID = d.ID
-	// 	eDevice.IP = d.IP
-	// 	eDevices = append(eDevices, &eDevice)
-	// }
+	eDevice := &externalDevice{UUID: int(instID), IP: ip}
+	eDevice.ChipType, _ = inst.String(deviceFieldChipType)
+	eDevice.Location, _ = inst.String(deviceFieldLocation)
+	eDevice.Tags, _ = inst.String(deviceFieldTags)
+	eDevice.SystemVersion, _ = inst.String(deviceFieldSysVersion)
+	return eDevice, nil
+}
+
+// searchDeviceInsts returns the cmdb instances of the devices with the given IPs
+func searchDeviceInsts(objectID string, deviceIPs []string) ([]mapstr.MapStr, error) {
+	insts, err := searchInsts(objectID, []metadata.AtomRule{
+		{Field: deviceFieldIP, Operator: metadata.Operator("in"), Value: deviceIPs},
+	}, []string{})
+	if err != nil {
+		logger.Wrapper.Errorf("Error. Failed to query %s devices %+v. %v", objectID, deviceIPs, err)
+		return nil, err
+	}
+	return insts, nil
+}
 
-	//SearchObjectInstances
-	resp2 := new(metadata.Response)
+// searchInsts returns the cmdb instances of the object matching all the rules
+func searchInsts(objectID string, rules []metadata.AtomRule, fields []string) ([]mapstr.MapStr, error) {
 	input := &metadata.CommonSearchFilter{
+		ObjectID: objectID,
 		Conditions: &metadata.CombinedRule{
 			Condition: metadata.Condition("AND"),
-			Rules:     []metadata.AtomRule{{Field: "bk_inst_id", Operator: metadata.Operator("in"), Value: []int{318, 319}}},
+			Rules:     rules,
 		},
-		Fields: []string{},
-		Page:   metadata.BasePage{Sort: "bk_inst_id", Start: 0, Limit: metadata.BKNoLimit},
+		Fields: fields,
+		Page:   metadata.BasePage{Sort: deviceFieldInstID, Start: 0, Limit: metadata.BKNoLimit},
 	}
 
-	err = CmdbApiClient.DoPost(context.Background(), CmdbServer+searchObjectInstsAPI, map[string]string{}, input).Into(resp2)
+	resp := new(metadata.SearchResp)
+	err := CmdbApiClient.DoPost(context.Background(), CmdbServer+fmt.Sprintf(searchObjectInstsAPI, objectID), map[string]string{}, input).Into(resp)
 	if err != nil {
-		logger.Wrapper.Errorf("Error. Failed to query %s bind devices on node %s. %v", deviceType, nodeName, err)
-		return eDevices, nil
+		return nil, err
 	}
 
-	return eDevices, nil
+	return resp.Data.Info, nil
 }
 
-func isDeviceHealthy(uuid int) bool {
-	healthy := true
-	// resp, err := CmdbApiClient.R().Get(CmdbServer + fmt.Sprintf(checkHealthAPI, uuid))
-	// _, _, err = checkHTTPResponse(resp, err)
-	// if err != nil {
-	// 	log.Printf("Error. Failed to get device healthy. %v", err.Error())
-	// 	// Default to true
-	// 	return healthy
-	// }
+// updateReservations updates the reservation fields of the devices in chunks of
+// at most BKMaxLimitSize instances and returns the result of every device.
+// Devices missing in cmdb or reserved by another node than node are not updated.
+func updateReservations(objectID string, deviceIPs []string, node string, data map[string]interface{}) []ReservationResult {
+	results := make([]ReservationResult, 0, len(deviceIPs))
+	insts, err := searchDeviceInsts(objectID, deviceIPs)
+	if err != nil {
+		for _, ip := range deviceIPs {
+			results = append(results, ReservationResult{IP: ip, Err: err})
+		}
+		return results
+	}
 
-	// var ret *HTTPRetBool
-	// _ = json.Unmarshal(resp.Body(), &ret)
-	// healthy = ret.Data
+	found := make(map[string]mapstr.MapStr, len(insts))
+	for _, inst := range insts {
+		ip, _ := inst.String(deviceFieldIP)
+		found[ip] = inst
+	}
+
+	var pending []int
+	var pendingInsts []mapstr.MapStr
+	seen := make(map[string]bool, len(deviceIPs))
+	for _, ip := range deviceIPs {
+		if seen[ip] {
+			continue
+		}
+		seen[ip] = true
+
+		result := ReservationResult{IP: ip}
+		inst, ok := found[ip]
+		if !ok {
+			result.Err = errors.New("not found in cmdb")
+		} else if owner, ok := reservedByOther(inst, node); ok {
+			result.Err = fmt.Errorf("reserved by node %s", owner)
+		} else if result.InstID, result.Err = inst.Int64(deviceFieldInstID); result.Err == nil {
+			pending = append(pending, len(results))
+			pendingInsts = append(pendingInsts, inst)
+		}
+		results = append(results, result)
+	}
+
+	for start := 0; start < len(pendingInsts); start += metadata.BKMaxLimitSize {
+		end := start + metadata.BKMaxLimitSize
+		if end > len(pendingInsts) {
+			end = len(pendingInsts)
+		}
+		if err := updateDeviceInsts(objectID, pendingInsts[start:end], data); err != nil {
+			for _, i := range pending[start:end] {
+				results[i].Err = err
+			}
+		}
+	}
+	return results
+}
+
+// ownerFields returns the cmdb fields of the owner of a device
+func ownerFields(owner DeviceOwner) map[string]string {
+	return map[string]string{
+		deviceFieldReservedPod:          owner.PodUID,
+		deviceFieldReservedPodName:      owner.PodName,
+		deviceFieldReservedPodNamespace: owner.PodNamespace,
+		deviceFieldReservedContainer:    owner.ContainerName,
+	}
+}
+
+// reservedByOther returns the node which reserved the device instance, when it
+// is another node than the given one
+func reservedByOther(inst mapstr.MapStr, node string) (string, bool) {
+	reserved, _ := inst.Int64(deviceFieldIsReserved)
+	owner, _ := inst.String(deviceFieldReservedNode)
+	if reserved != 0 && owner != "" && owner != node {
+		return owner, true
+	}
+	return "", false
+}
+
+// updateDeviceInsts updates the given cmdb device instances with the same data
+func updateDeviceInsts(objectID string, insts []mapstr.MapStr, data map[string]interface{}) error {
+	if len(insts) == 0 {
+		return nil
+	}
+
+	option := metadata.OpCondition{}
+	for _, inst := range insts {
+		instID, err := inst.Int64(deviceFieldInstID)
+		if err != nil {
+			return err
+		}
+		option.Update = append(option.Update, metadata.UpdateCondition{InstID: instID, InstInfo: data})
+	}
 
-	return healthy
+	resp := new(metadata.Response)
+	return CmdbApiClient.DoPut(context.Background(), CmdbServer+fmt.Sprintf(batchUpdateInstsAPI, objectID), map[string]string{}, option).Into(resp)
 }
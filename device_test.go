@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"carizon-device-plugin/conf"
+	"carizon-device-plugin/metadata"
+	httpclient "carizon-device-plugin/pkg/client"
+	"carizon-device-plugin/pkg/fakecmdb"
+	"carizon-device-plugin/pkg/mapstr"
+)
+
+func TestDevicesFromCMDB(t *testing.T) {
+	cmdb := newFakeCMDB(t)
+	node1, node2 := cmdb.AddHost("node-1"), cmdb.AddHost("node-2")
+	d1 := cmdb.AddDevice("J5", node1, mapstr.MapStr{"ip": "10.0.0.1", "chip_type": "J5", "location": "rack-1"})
+	cmdb.AddDevice("J5", node1, mapstr.MapStr{"ip": "10.0.0.2", "status": DeviceOffline})
+	d3 := cmdb.AddDevice("J5", node1, mapstr.MapStr{"ip": "10.0.0.3"})
+	cmdb.AddDevice("J5", node2, mapstr.MapStr{"ip": "10.0.0.4"})
+
+	m := NewCarizonDeviceManager(conf.Resource{ResourceName: "J5", Filter: conf.Filter{NodeName: "node-1"}})
+	devices, err := m.Devices()
+	require.NoError(t, err)
+	require.Len(t, devices, 2)
+	require.Equal(t, "10.0.0.1", devices[0].ID)
+	require.Equal(t, int(d1), devices[0].UUID)
+	require.Equal(t, "J5", devices[0].ChipType)
+	require.Equal(t, "rack-1", devices[0].Location)
+	require.Equal(t, "10.0.0.3", devices[1].ID)
+
+	m = NewCarizonDeviceManager(conf.Resource{ResourceName: "J5", Filter: conf.Filter{NodeName: "node-1", ID: map[string]interface{}{"$gt": d1}}})
+	devices, err = m.Devices()
+	require.NoError(t, err)
+	require.Len(t, devices, 1)
+	require.Equal(t, int(d3), devices[0].UUID)
+
+	m = NewCarizonDeviceManager(conf.Resource{ResourceName: "J5", Filter: conf.Filter{NodeName: "node-3"}})
+	devices, err = m.Devices()
+	require.NoError(t, err)
+	require.Empty(t, devices)
+}
+
+func TestDevicesCMDBErrors(t *testing.T) {
+	cmdb := newFakeCMDB(t)
+	node := cmdb.AddHost("node-1")
+	cmdb.AddDevice("J5", node, mapstr.MapStr{"ip": "10.0.0.1"})
+	m := NewCarizonDeviceManager(conf.Resource{ResourceName: "J5", Filter: conf.Filter{NodeName: "node-1"}})
+
+	cmdb.FailResult(fakecmdb.APIFindInstAssociation, fakecmdb.ErrCodeNotFound, "association not found")
+	_, err := m.Devices()
+	require.True(t, httpclient.IsCCError(err))
+	require.Equal(t, "association not found", err.Error())
+
+	cmdb.FailResult(fakecmdb.APIFindInstAssociation, 0, "")
+	cmdb.FailHTTP(fakecmdb.APISearchInsts, http.StatusBadGateway)
+	_, err = m.Devices()
+	require.Error(t, err)
+	require.False(t, httpclient.IsCCError(err))
+}
+
+func TestReleaseKeepsDevicesOfOtherNodes(t *testing.T) {
+	prev := NodeName
+	NodeName = "node-1"
+	defer func() { NodeName = prev }()
+
+	cmdb := newFakeCMDB(t)
+	node := cmdb.AddHost("node-1")
+	d1 := cmdb.AddDevice("J5", node, mapstr.MapStr{"ip": "10.0.0.1", "is_reserved": 1, "reserved_node": "node-1"})
+	d2 := cmdb.AddDevice("J5", node, mapstr.MapStr{"ip": "10.0.0.2", "is_reserved": 1, "reserved_node": "node-2"})
+
+	NewCarizonDeviceManager(conf.Resource{ResourceName: "J5"}).Release([]string{"10.0.0.1", "10.0.0.2"})
+	require.EqualValues(t, 0, cmdb.Instance("J5", d1)["is_reserved"])
+	require.Equal(t, "", cmdb.Instance("J5", d1)["reserved_node"])
+	require.EqualValues(t, 1, cmdb.Instance("J5", d2)["is_reserved"])
+	require.Equal(t, "node-2", cmdb.Instance("J5", d2)["reserved_node"])
+}
+
+func TestGetAllocateDevicesInfo(t *testing.T) {
+	cmdb := newFakeCMDB(t)
+	node := cmdb.AddHost("node-1")
+	cmdb.AddDevice("J5", node, mapstr.MapStr{"ip": "10.0.0.1", "vnet_ip": "192.168.0.1"})
+	cmdb.AddDevice("J5", node, mapstr.MapStr{"ip": "10.0.0.2"})
+	cmdb.AddDevice("J5", node, mapstr.MapStr{"ip": "10.0.0.3", "vnet_ip": "192.168.0.3"})
+	m := NewCarizonDeviceManager(conf.Resource{ResourceName: resourceDomain})
+
+	info, err := m.GetAllocateDevicesInfo([]string{"10.0.0.1", "10.0.0.2"})
+	require.NoError(t, err)
+	require.Equal(t, []PCIeAddressInfo{{IP: "10.0.0.1", VNetIP: "192.168.0.1"}}, *info)
+	require.Equal(t, []string{"10.0.0.2"}, missingPCIeInfo([]string{"10.0.0.1", "10.0.0.2"}, *info))
+
+	cmdb.FailResult(fakecmdb.APIListDevices, 1, "unavailable")
+	_, err = m.GetAllocateDevicesInfo([]string{"10.0.0.1"})
+	require.Error(t, err)
+
+	cmdb.FailHTTP(fakecmdb.APIListDevices, http.StatusBadGateway)
+	_, err = m.GetAllocateDevicesInfo([]string{"10.0.0.1"})
+	require.Error(t, err)
+}
+
+func TestAllocateReservesDevices(t *testing.T) {
+	cmdb := newFakeCMDB(t)
+	node := cmdb.AddHost("node-1")
+	d1 := cmdb.AddDevice("J5", node, mapstr.MapStr{"ip": "10.0.0.1"})
+	d2 := cmdb.AddDevice("J5", node, mapstr.MapStr{"ip": "10.0.0.2", "is_reserved": 1, "reserved_node": "node-2"})
+	m := NewCarizonDeviceManager(conf.Resource{ResourceName: "J5"})
+
+	owner := DeviceOwner{PodUID: "pod-1", PodName: "train-0", PodNamespace: "ml", ContainerName: "worker"}
+	results := m.Allocate([]string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, Reservation{Node: "node-1", DeviceOwner: owner})
+	require.Len(t, results, 3)
+	require.Equal(t, ReservationResult{IP: "10.0.0.1", InstID: d1}, results[0])
+	require.EqualError(t, results[1].Err, "reserved by node node-2")
+	require.EqualError(t, results[2].Err, "not found in cmdb")
+	require.Error(t, reservationError(results))
+
+	inst := cmdb.Instance("J5", d1)
+	require.EqualValues(t, 1, inst["is_reserved"])
+	require.Equal(t, "node-1", inst["reserved_node"])
+	require.Equal(t, "pod-1", inst["reserved_pod_uid"])
+	require.Equal(t, "train-0", inst["reserved_pod_name"])
+	require.Equal(t, "ml", inst["reserved_pod_namespace"])
+	require.Equal(t, "worker", inst["reserved_container"])
+	require.NotEmpty(t, inst["reserved_time"])
+	require.Equal(t, "node-2", cmdb.Instance("J5", d2)["reserved_node"])
+
+	// the pod recorded before is kept when it is unknown
+	results = m.Allocate([]string{"10.0.0.1"}, Reservation{Node: "node-1", KeepOwner: true})
+	require.NoError(t, reservationError(results))
+	require.Equal(t, "pod-1", cmdb.Instance("J5", d1)["reserved_pod_uid"])
+	require.Equal(t, "train-0", cmdb.Instance("J5", d1)["reserved_pod_name"])
+
+	// a new owner replaces every field of the old one
+	owner = DeviceOwner{PodName: "train-1", PodNamespace: "ml", ContainerName: "worker"}
+	results = m.Allocate([]string{"10.0.0.1"}, Reservation{Node: "node-1", DeviceOwner: owner})
+	require.NoError(t, reservationError(results))
+	inst = cmdb.Instance("J5", d1)
+	require.Equal(t, "", inst["reserved_pod_uid"])
+	require.Equal(t, "train-1", inst["reserved_pod_name"])
+	require.Equal(t, "ml", inst["reserved_pod_namespace"])
+	require.Equal(t, "worker", inst["reserved_container"])
+
+	prev := NodeName
+	NodeName = "node-1"
+	defer func() { NodeName = prev }()
+	m.Release([]string{"10.0.0.1"})
+	inst = cmdb.Instance("J5", d1)
+	require.EqualValues(t, 0, inst["is_reserved"])
+	for _, field := range []string{"reserved_node", "reserved_pod_uid", "reserved_pod_name", "reserved_pod_namespace", "reserved_container", "reserved_time"} {
+		require.Equal(t, "", inst[field], field)
+	}
+
+	cmdb.FailResult(fakecmdb.APIUpdateInsts, 1199000, "update failed")
+	results = m.Allocate([]string{"10.0.0.1"}, Reservation{Node: "node-1"})
+	require.True(t, httpclient.IsCCError(results[0].Err))
+}
+
+func TestAllocateUpdatesInChunks(t *testing.T) {
+	cmdb := newFakeCMDB(t)
+	node := cmdb.AddHost("node-1")
+	var ips []string
+	for i := 0; i < metadata.BKMaxLimitSize*2+1; i++ {
+		ip := fmt.Sprintf("10.0.%d.%d", i/250, i%250)
+		cmdb.AddDevice("J5", node, mapstr.MapStr{"ip": ip})
+		ips = append(ips, ip)
+	}
+
+	results := NewCarizonDeviceManager(conf.Resource{ResourceName: "J5"}).Allocate(ips, Reservation{Node: "node-1"})
+	require.Len(t, results, len(ips))
+	require.NoError(t, reservationError(results))
+	require.Equal(t, 3, cmdb.Requests(fakecmdb.APIUpdateInsts))
+}
+
+func TestLease(t *testing.T) {
+	prev := NodeName
+	NodeName = "node-1"
+	defer func() { NodeName = prev }()
+
+	cmdb := newFakeCMDB(t)
+	node := cmdb.AddHost("node-1")
+	d1 := cmdb.AddDevice("J5", node, mapstr.MapStr{"ip": "10.0.0.1"})
+	d2 := cmdb.AddDevice("J5", node, mapstr.MapStr{"ip": "10.0.0.2", "is_reserved": 1, "reserved_node": "node-1"})
+	cmdb.AddDevice("J5", node, mapstr.MapStr{"ip": "10.0.0.3", "status": DeviceOffline})
+	d4 := cmdb.AddDevice("J5", node, mapstr.MapStr{"ip": "10.0.0.4", "is_reserved": 1, "reserved_node": "node-2"})
+	m := NewCarizonDeviceManager(conf.Resource{ResourceName: "J5"})
+
+	require.NoError(t, m.Lease([]string{"10.0.0.1", "10.0.0.2"}))
+	for _, id := range []int64{d1, d2} {
+		require.EqualValues(t, 1, cmdb.Instance("J5", id)["is_reserved"])
+		require.Equal(t, "node-1", cmdb.Instance("J5", id)["reserved_node"])
+	}
+
+	for _, tc := range []struct {
+		ips []string
+		err string
+	}{
+		{[]string{"10.0.0.1", "10.0.0.9"}, "device 10.0.0.9 not found in cmdb"},
+		{[]string{"10.0.0.3"}, "device 10.0.0.3 is offline"},
+		{[]string{"10.0.0.4"}, "device 10.0.0.4 is reserved by node node-2"},
+	} {
+		require.EqualError(t, m.Lease(tc.ips), tc.err)
+	}
+	require.Equal(t, "node-2", cmdb.Instance("J5", d4)["reserved_node"])
+}
+
+func TestReserved(t *testing.T) {
+	prev := NodeName
+	NodeName = "node-1"
+	defer func() { NodeName = prev }()
+
+	cmdb := newFakeCMDB(t)
+	node := cmdb.AddHost("node-1")
+	cmdb.AddDevice("J5", node, mapstr.MapStr{"ip": "10.0.0.1", "is_reserved": 1, "reserved_node": "node-1"})
+	cmdb.AddDevice("J5", node, mapstr.MapStr{"ip": "10.0.0.2"})
+	cmdb.AddDevice("J5", node, mapstr.MapStr{"ip": "10.0.0.3", "is_reserved": 1, "reserved_node": "node-2"})
+	cmdb.AddDevice("J5", node, mapstr.MapStr{"ip": "10.0.0.4", "is_reserved": 0, "reserved_node": "node-1"})
+	m := NewCarizonDeviceManager(conf.Resource{ResourceName: "J5"})
+
+	ips, err := m.Reserved()
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.1"}, ips)
+
+	cmdb.FailHTTP(fakecmdb.APISearchInsts, http.StatusBadGateway)
+	_, err = m.Reserved()
+	require.Error(t, err)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"carizon-device-plugin/pkg/logger"
+)
+
+const defaultDiscoveryInterval = 5 * time.Minute
+
+func (h *CarizonDevicePlugin) discoveryInterval() time.Duration {
+	if h.resource.DiscoveryInterval == 0 {
+		return defaultDiscoveryInterval
+	}
+	return h.resource.DiscoveryInterval
+}
+
+// startHealthCheck (re)starts the health checks of the devices, unless the
+// plugin has been stopped. The health check gets copies of the devices with
+// their current health, they are owned by the health check.
+func (h *CarizonDevicePlugin) startHealthCheck(stop <-chan interface{}, devices []*Device) {
+	h.Lock()
+	defer h.Unlock()
+
+	select {
+	case <-stop:
+		return
+	default:
+	}
+
+	if h.healthStop != nil {
+		close(h.healthStop)
+	}
+	checked := make([]*Device, 0, len(devices))
+	h.checked = make(map[string]*Device, len(devices))
+	for _, d := range devices {
+		c := *d
+		c.Health = h.healthState[d.ID]
+		checked = append(checked, &c)
+		h.checked[d.ID] = &c
+	}
+	h.healthStop = make(chan interface{})
+	go h.CheckHealth(h.healthStop, checked, h.health, h.unhealth)
+}
+
+// rediscover refreshes the device list every interval until stop is closed
+func (h *CarizonDevicePlugin) rediscover(stop <-chan interface{}, interval time.Duration) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+		h.refreshDevices(stop)
+	}
+}
+
+// refreshDevices discovers the devices again and pushes the new device list to
+// kubelet when devices were added or removed. Devices which are no longer
+// discovered but still held by pods are kept as retired until they are released.
+func (h *CarizonDevicePlugin) refreshDevices(stop <-chan interface{}) {
+	discovered, err := h.Devices()
+	if err != nil {
+		logger.Wrapper.Errorf("Rediscover '%s' devices error, keep the cached devices: %v", h.resourceName, err)
+		return
+	}
+
+	cached := h.devices()
+	var held map[string]bool
+	if len(missingDevices(cached, discovered)) != 0 {
+		held, err = heldDevices(h.resourceName)
+		if err != nil {
+			logger.Wrapper.Errorf("Get held '%s' devices error, retire all missing devices: %v", h.resourceName, err)
+		}
+	}
+
+	h.Lock()
+	merged, retired, changed := mergeDevices(h.cachedDevices, discovered, held, h.retired)
+	if changed {
+		// devices keep their health, new ones start with the discovered health
+		health := make(map[string]string, len(merged))
+		for _, d := range merged {
+			if current, ok := h.healthState[d.ID]; ok {
+				health[d.ID] = current
+			} else {
+				health[d.ID] = d.Health
+			}
+		}
+		h.cachedDevices = merged
+		h.healthState = health
+		h.retired = retired
+	}
+	h.Unlock()
+
+	if !changed {
+		return
+	}
+	log.Printf("'%s' devices changed, %d devices now, %d retired", h.resourceName, len(merged), len(retired))
+	h.notifyUpdate()
+	notifyNodeFeatures()
+	h.startHealthCheck(stop, merged)
+}
+
+// mergeDevices merges the discovered devices into the cached ones, devices
+// whose attributes changed are replaced. Missing devices are retired when held
+// is nil or they are in held, otherwise dropped.
+func mergeDevices(cached, discovered []*Device, held, wasRetired map[string]bool) ([]*Device, map[string]bool, bool) {
+	known := make(map[string]*Device, len(cached))
+	for _, d := range cached {
+		known[d.ID] = d
+	}
+
+	changed := false
+	seen := make(map[string]bool, len(discovered))
+	merged := make([]*Device, 0, len(discovered))
+	for _, d := range discovered {
+		if seen[d.ID] {
+			continue
+		}
+		seen[d.ID] = true
+		if c, ok := known[d.ID]; ok {
+			if c.externalDevice != d.externalDevice {
+				// attributes such as the system version changed
+				c = d
+				changed = true
+			}
+			merged = append(merged, c)
+			changed = changed || wasRetired[d.ID]
+		} else {
+			merged = append(merged, d)
+			changed = true
+		}
+	}
+
+	retired := make(map[string]bool)
+	for _, d := range missingDevices(cached, discovered) {
+		if held == nil || held[d.ID] {
+			merged = append(merged, d)
+			retired[d.ID] = true
+			changed = changed || !wasRetired[d.ID]
+		} else {
+			changed = true
+		}
+	}
+	return merged, retired, changed
+}
+
+// missingDevices returns the cached devices which are not discovered anymore
+func missingDevices(cached, discovered []*Device) []*Device {
+	found := make(map[string]bool, len(discovered))
+	for _, d := range discovered {
+		found[d.ID] = true
+	}
+
+	var missing []*Device
+	for _, d := range cached {
+		if !found[d.ID] {
+			missing = append(missing, d)
+		}
+	}
+	return missing
+}
+
+// heldDevices returns the devices of the resource held by pods
+func heldDevices(resourceName string) (map[string]bool, error) {
+	client, err := GetResourceClient("")
+	if err != nil {
+		return nil, err
+	}
+	resourceInfos, err := client.GetPodResourceMap()
+	if err != nil {
+		return nil, err
+	}
+
+	held := make(map[string]bool)
+	if info, ok := resourceInfos[resourceName]; ok {
+		for _, id := range info.DeviceIDs {
+			held[id] = true
+		}
+	}
+	return held, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"carizon-device-plugin/conf"
+)
+
+func TestMergeDevices(t *testing.T) {
+	device := func(ip, version, health string) *Device {
+		d := buildDevice(&externalDevice{IP: ip, SystemVersion: version})
+		d.Health = health
+		return d
+	}
+	healthy, unhealthy := pluginapi.Healthy, pluginapi.Unhealthy
+
+	for _, tc := range []struct {
+		name       string
+		cached     []*Device
+		discovered []*Device
+		held       map[string]bool
+		wasRetired map[string]bool
+		merged     []*Device
+		retired    map[string]bool
+		changed    bool
+	}{
+		{
+			name:       "unchanged",
+			cached:     []*Device{device("10.0.0.1", "1.0", unhealthy)},
+			discovered: []*Device{device("10.0.0.1", "1.0", healthy)},
+			merged:     []*Device{device("10.0.0.1", "1.0", unhealthy)},
+			retired:    map[string]bool{},
+		},
+		{
+			name:       "added",
+			cached:     []*Device{device("10.0.0.1", "1.0", healthy)},
+			discovered: []*Device{device("10.0.0.1", "1.0", healthy), device("10.0.0.2", "1.0", healthy), device("10.0.0.2", "1.0", healthy)},
+			merged:     []*Device{device("10.0.0.1", "1.0", healthy), device("10.0.0.2", "1.0", healthy)},
+			retired:    map[string]bool{},
+			changed:    true,
+		},
+		{
+			name:       "attributes updated",
+			cached:     []*Device{device("10.0.0.1", "1.0", unhealthy)},
+			discovered: []*Device{device("10.0.0.1", "1.1", healthy)},
+			merged:     []*Device{device("10.0.0.1", "1.1", healthy)},
+			retired:    map[string]bool{},
+			changed:    true,
+		},
+		{
+			name:       "removed",
+			cached:     []*Device{device("10.0.0.1", "1.0", healthy), device("10.0.0.2", "1.0", healthy)},
+			discovered: []*Device{device("10.0.0.1", "1.0", healthy)},
+			held:       map[string]bool{},
+			merged:     []*Device{device("10.0.0.1", "1.0", healthy)},
+			retired:    map[string]bool{},
+			changed:    true,
+		},
+		{
+			name:       "removed but held",
+			cached:     []*Device{device("10.0.0.1", "1.0", healthy), device("10.0.0.2", "1.0", healthy)},
+			discovered: []*Device{device("10.0.0.1", "1.0", healthy)},
+			held:       map[string]bool{"10.0.0.2": true},
+			merged:     []*Device{device("10.0.0.1", "1.0", healthy), device("10.0.0.2", "1.0", healthy)},
+			retired:    map[string]bool{"10.0.0.2": true},
+			changed:    true,
+		},
+		{
+			name:       "removed without pod resources",
+			cached:     []*Device{device("10.0.0.1", "1.0", healthy)},
+			discovered: []*Device{},
+			merged:     []*Device{device("10.0.0.1", "1.0", healthy)},
+			retired:    map[string]bool{"10.0.0.1": true},
+			changed:    true,
+		},
+		{
+			name:       "still retired",
+			cached:     []*Device{device("10.0.0.1", "1.0", healthy), device("10.0.0.2", "1.0", healthy)},
+			discovered: []*Device{device("10.0.0.1", "1.0", healthy)},
+			held:       map[string]bool{"10.0.0.2": true},
+			wasRetired: map[string]bool{"10.0.0.2": true},
+			merged:     []*Device{device("10.0.0.1", "1.0", healthy), device("10.0.0.2", "1.0", healthy)},
+			retired:    map[string]bool{"10.0.0.2": true},
+		},
+		{
+			name:       "retired released",
+			cached:     []*Device{device("10.0.0.1", "1.0", healthy), device("10.0.0.2", "1.0", healthy)},
+			discovered: []*Device{device("10.0.0.1", "1.0", healthy)},
+			held:       map[string]bool{},
+			wasRetired: map[string]bool{"10.0.0.2": true},
+			merged:     []*Device{device("10.0.0.1", "1.0", healthy)},
+			retired:    map[string]bool{},
+			changed:    true,
+		},
+		{
+			name:       "retired discovered again",
+			cached:     []*Device{device("10.0.0.1", "1.0", healthy)},
+			discovered: []*Device{device("10.0.0.1", "1.0", healthy)},
+			wasRetired: map[string]bool{"10.0.0.1": true},
+			merged:     []*Device{device("10.0.0.1", "1.0", healthy)},
+			retired:    map[string]bool{},
+			changed:    true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			merged, retired, changed := mergeDevices(tc.cached, tc.discovered, tc.held, tc.wasRetired)
+			require.Equal(t, tc.merged, merged)
+			require.Equal(t, tc.retired, retired)
+			require.Equal(t, tc.changed, changed)
+		})
+	}
+}
+
+func TestRefreshDevicesKeepsHealth(t *testing.T) {
+	m := newStubManager("10.0.0.1")
+	p := NewCarizonDevicePlugin(testResourceName, m, testDeviceEnv, "", conf.Resource{ResourceName: testResourceName})
+	require.NoError(t, p.initialize())
+	defer p.cleanup()
+	p.startHealthCheck(p.stop, p.devices())
+
+	previous := p.checked["10.0.0.1"]
+	require.True(t, p.setHealth(previous, pluginapi.Unhealthy))
+
+	// a new device restarts the health check, the known device keeps its health
+	m.Lock()
+	m.ips = append(m.ips, "10.0.0.2")
+	m.Unlock()
+	p.refreshDevices(p.stop)
+	health := func() map[string]string {
+		health := make(map[string]string)
+		for _, d := range p.apiDevices() {
+			health[d.ID] = d.Health
+		}
+		return health
+	}
+	require.Equal(t, map[string]string{"10.0.0.1": pluginapi.Unhealthy, "10.0.0.2": pluginapi.Healthy}, health())
+	require.Equal(t, pluginapi.Unhealthy, p.checked["10.0.0.1"].Health)
+
+	// a late report of the previous health check is ignored
+	require.False(t, p.setHealth(previous, pluginapi.Healthy))
+	require.Equal(t, map[string]string{"10.0.0.1": pluginapi.Unhealthy, "10.0.0.2": pluginapi.Healthy}, health())
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"time"
+
+	"carizon-device-plugin/pkg/logger"
+	"carizon-device-plugin/pkg/metrics"
+
+	v1 "k8s.io/api/core/v1"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// drift kinds
+const (
+	driftUnknown = "unknown"
+	driftMissing = "missing"
+)
+
+// deviceDrift is the difference between the devices of a plugin and the devices
+// kubelet can allocate for its resource
+type deviceDrift struct {
+	// Unknown are the devices kubelet can allocate which the plugin doesn't serve
+	Unknown []string
+	// Missing are the healthy devices of the plugin kubelet can't allocate
+	Missing []string
+}
+
+func (d deviceDrift) empty() bool {
+	return len(d.Unknown) == 0 && len(d.Missing) == 0
+}
+
+// checkDeviceDrift compares the devices of the registered plugins with the
+// allocatable devices of kubelet, and sends the device list again to kubelet
+// when they drifted apart
+func checkDeviceDrift(plugins []*CarizonDevicePlugin, client ResourceClient) {
+	allocatable, err := client.GetAllocatableDevices()
+	if err != nil {
+		logger.Wrapper.Infof("[checkDeviceDrift] Skip drift detection: %v", err)
+		return
+	}
+
+	for _, p := range plugins {
+		drift, ok := p.deviceDrift(allocatable[p.resourceName])
+		if !ok {
+			continue
+		}
+		metrics.DeviceDrift.WithLabelValues(p.resourceName, driftUnknown).Set(float64(len(drift.Unknown)))
+		metrics.DeviceDrift.WithLabelValues(p.resourceName, driftMissing).Set(float64(len(drift.Missing)))
+		if drift.empty() {
+			continue
+		}
+
+		logger.Wrapper.Errorf("[checkDeviceDrift] %s drifted from kubelet, unknown devices: %v, missing devices: %v",
+			p.resourceName, drift.Unknown, drift.Missing)
+		recordNodeEvent(v1.EventTypeWarning, reasonDeviceDrift, "Devices of %s drifted from kubelet, unknown: %v, missing: %v",
+			p.resourceName, drift.Unknown, drift.Missing)
+		p.notifyUpdate()
+	}
+}
+
+// deviceDrift compares the devices of the plugin with the devices kubelet can
+// allocate. It returns false when the plugin is not registered or kubelet may
+// not have received its device list yet.
+func (h *CarizonDevicePlugin) deviceDrift(allocatable []string) (deviceDrift, bool) {
+	h.RLock()
+	registeredAt := h.registeredAt
+	h.RUnlock()
+	if registeredAt.IsZero() || time.Since(registeredAt) < registrationGracePeriod {
+		return deviceDrift{}, false
+	}
+
+	var drift deviceDrift
+	served := make(map[string]bool)
+	kubelet := make(map[string]bool, len(allocatable))
+	for _, id := range allocatable {
+		kubelet[id] = true
+	}
+	for _, d := range h.apiDevices() {
+		served[d.ID] = true
+		if d.Health == pluginapi.Healthy && !kubelet[d.ID] {
+			drift.Missing = append(drift.Missing, d.ID)
+		}
+	}
+	for _, id := range allocatable {
+		if !served[id] {
+			drift.Unknown = append(drift.Unknown, id)
+		}
+	}
+	return drift, true
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"carizon-device-plugin/conf"
+)
+
+func TestDeviceDrift(t *testing.T) {
+	p := NewCarizonDevicePlugin(testResourceName, newStubManager(), testDeviceEnv, "", conf.Resource{ResourceName: testResourceName})
+	devices := []*Device{newTestDevice(1, "10.0.0.1"), newTestDevice(2, "10.0.0.2"), newTestDevice(3, "10.0.0.3")}
+	devices[2].Health = pluginapi.Unhealthy
+	p.setCachedDevices(devices)
+
+	_, ok := p.deviceDrift([]string{"10.0.0.1"})
+	require.False(t, ok, "not registered")
+	p.registeredAt = time.Now()
+	_, ok = p.deviceDrift([]string{"10.0.0.1"})
+	require.False(t, ok, "kubelet may not have the device list yet")
+
+	p.registeredAt = time.Now().Add(-registrationGracePeriod)
+	drift, ok := p.deviceDrift([]string{"10.0.0.1", "10.0.0.2"})
+	require.True(t, ok)
+	require.True(t, drift.empty())
+
+	// unhealthy devices may or may not be allocatable in kubelet
+	drift, _ = p.deviceDrift([]string{"10.0.0.1", "10.0.0.3", "10.0.0.9"})
+	require.Equal(t, []string{"10.0.0.9"}, drift.Unknown)
+	require.Equal(t, []string{"10.0.0.2"}, drift.Missing)
+}
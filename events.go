@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+
+	"carizon-device-plugin/pkg/logger"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const eventComponent = "carizon-device-plugin"
+
+// event reasons
+const (
+	reasonDeviceUnhealthy   = "DeviceUnhealthy"
+	reasonDeviceHealthy     = "DeviceHealthy"
+	reasonAllocationFailed  = "AllocationFailed"
+	reasonPCIeInfoMissing   = "PCIeInfoMissing"
+	reasonReservationFailed = "ReservationFailed"
+	reasonDeviceDrift       = "DeviceDrift"
+)
+
+// kubeClient is the in-cluster kubernetes client, nil when not running in a cluster
+var kubeClient kubernetes.Interface
+
+// eventRecorder publishes events to the api server, nil when events are disabled
+var eventRecorder record.EventRecorder
+
+// initKubeClient creates the in-cluster kubernetes client and the event
+// recorder. Events are disabled when the plugin does not run in a cluster.
+func initKubeClient() {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		logger.Wrapper.Infof("[events] Not running in a cluster, events disabled: %s", err.Error())
+		return
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		logger.Wrapper.Errorf("[events] Create kubernetes client error, events disabled: %s", err.Error())
+		return
+	}
+	kubeClient = client
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	eventRecorder = broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: eventComponent, Host: NodeName})
+}
+
+// nodeRef references the node of the plugin, kubelet uses the node name as its UID in events
+func nodeRef() *v1.ObjectReference {
+	return &v1.ObjectReference{Kind: "Node", Name: NodeName, UID: types.UID(NodeName)}
+}
+
+// recordNodeEvent publishes an event against the node of the plugin
+func recordNodeEvent(eventType, reason, messageFmt string, args ...interface{}) {
+	if eventRecorder == nil {
+		return
+	}
+	eventRecorder.Eventf(nodeRef(), eventType, reason, messageFmt, args...)
+}
+
+// recordDeviceEvent publishes an event about a device against the node and
+// against the pods holding the device if they can be resolved from podresources
+func (h *CarizonDevicePlugin) recordDeviceEvent(d *Device, eventType, reason string) {
+	if eventRecorder == nil {
+		return
+	}
+
+	message := fmt.Sprintf("Device %s of %s: %s", d.IP, h.resourceName, reason)
+	recordNodeEvent(eventType, reason, "%s", message)
+
+	pods, err := devicePods(h.resourceName, d.ID)
+	if err != nil {
+		logger.Wrapper.Errorf("[events] Resolve pods holding device %s error: %v", d.IP, err)
+		return
+	}
+	for _, pod := range pods {
+		eventRecorder.Event(pod, eventType, reason, message)
+	}
+}
+
+// devicePods returns the pods holding the device of the resource. Pods can only
+// be resolved through the kubelet pod resources api, the checkpoint has no pod names.
+func devicePods(resourceName, id string) ([]*v1.ObjectReference, error) {
+	resources, err := kubeletPodResources()
+	if err != nil {
+		return nil, err
+	}
+
+	var pods []*v1.ObjectReference
+	for i := range resources {
+		pr := &resources[i]
+		if pr.Name != "" && podHoldsDevice(pr, resourceName, id) {
+			pods = append(pods, &v1.ObjectReference{Kind: "Pod", Namespace: pr.Namespace, Name: pr.Name})
+		}
+	}
+	return pods, nil
+}
+
+func podHoldsDevice(pr *PodResources, resourceName, id string) bool {
+	for _, cnt := range pr.Containers {
+		for _, dev := range cnt.Devices {
+			if dev.ResourceName != resourceName {
+				continue
+			}
+			for _, devID := range dev.DeviceIDs {
+				if devID == id {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// allocateDeviceIDs returns the device IDs of all the container requests
+func allocateDeviceIDs(reqs *pluginapi.AllocateRequest) []string {
+	var ids []string
+	for _, req := range reqs.ContainerRequests {
+		ids = append(ids, req.DevicesIDs...)
+	}
+	return ids
+}
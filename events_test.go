@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// newFakeRecorder records the events of the test on the node node-1
+func newFakeRecorder(t *testing.T) *record.FakeRecorder {
+	recorder := record.NewFakeRecorder(16)
+	recorder.IncludeObject = true
+	prevRecorder, prevNode := eventRecorder, NodeName
+	eventRecorder, NodeName = recorder, "node-1"
+	t.Cleanup(func() { eventRecorder, NodeName = prevRecorder, prevNode })
+	return recorder
+}
+
+func nextEvent(t *testing.T, recorder *record.FakeRecorder) string {
+	select {
+	case e := <-recorder.Events:
+		return e
+	case <-time.After(testTimeout):
+		t.Fatal("no event recorded")
+		return ""
+	}
+}
+
+func noEvent(t *testing.T, recorder *record.FakeRecorder) {
+	select {
+	case e := <-recorder.Events:
+		t.Fatalf("unexpected event %s", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDeviceHealthEvents(t *testing.T) {
+	recorder := newFakeRecorder(t)
+	k := newFakeKubelet(t)
+	k.setPodResources(newTestPod("pod-1", testResourceName, "10.0.0.2"))
+	m := newStubManager("10.0.0.1", "10.0.0.2")
+	p := newTestPlugin(k, m)
+	require.NoError(t, p.Start())
+	defer p.Stop()
+	updates := k.watch(t, k.connect(t, k.waitRegistered(t)))
+	nextUpdate(t, updates)
+
+	// the event is recorded against the node and the pod holding the device
+	m.flip(t, "10.0.0.2", false)
+	nextUpdate(t, updates)
+	require.Equal(t, "Warning DeviceUnhealthy Device 10.0.0.2 of carizon.io/test: DeviceUnhealthy involvedObject{kind=Node,apiVersion=}", nextEvent(t, recorder))
+	require.Equal(t, "Warning DeviceUnhealthy Device 10.0.0.2 of carizon.io/test: DeviceUnhealthy involvedObject{kind=Pod,apiVersion=}", nextEvent(t, recorder))
+
+	m.flip(t, "10.0.0.2", true)
+	nextUpdate(t, updates)
+	require.Equal(t, "Normal DeviceHealthy Device 10.0.0.2 of carizon.io/test: DeviceHealthy involvedObject{kind=Node,apiVersion=}", nextEvent(t, recorder))
+	require.Equal(t, "Normal DeviceHealthy Device 10.0.0.2 of carizon.io/test: DeviceHealthy involvedObject{kind=Pod,apiVersion=}", nextEvent(t, recorder))
+
+	// no pod holds the device
+	m.flip(t, "10.0.0.1", false)
+	nextUpdate(t, updates)
+	require.Equal(t, "Warning DeviceUnhealthy Device 10.0.0.1 of carizon.io/test: DeviceUnhealthy involvedObject{kind=Node,apiVersion=}", nextEvent(t, recorder))
+	noEvent(t, recorder)
+
+	// the node still gets the event when the pods can't be resolved
+	k.setPodResourcesError(errors.New("kubelet unavailable"))
+	m.flip(t, "10.0.0.1", true)
+	nextUpdate(t, updates)
+	require.Equal(t, "Normal DeviceHealthy Device 10.0.0.1 of carizon.io/test: DeviceHealthy involvedObject{kind=Node,apiVersion=}", nextEvent(t, recorder))
+	noEvent(t, recorder)
+}
+
+func TestAllocationFailedEvent(t *testing.T) {
+	recorder := newFakeRecorder(t)
+	k := newFakeKubelet(t)
+	p := newTestPlugin(k, newStubManager("10.0.0.1"))
+	require.NoError(t, p.Start())
+	defer p.Stop()
+	client := k.connect(t, k.waitRegistered(t))
+
+	_, err := client.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"10.0.0.1"}}},
+	})
+	require.NoError(t, err)
+	noEvent(t, recorder)
+
+	_, err = client.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"10.0.0.1"}}, {DevicesIDs: []string{"10.0.0.3"}}},
+	})
+	require.Error(t, err)
+	require.Equal(t, "Warning AllocationFailed Allocate carizon.io/test devices [10.0.0.1 10.0.0.3]: "+
+		"invalid allocation request for 'carizon.io/test': unknown device: 10.0.0.3 involvedObject{kind=Node,apiVersion=}", nextEvent(t, recorder))
+}
+
+func TestDevicePods(t *testing.T) {
+	k := newFakeKubelet(t)
+	checkpointPod := newTestPod("", testResourceName, "10.0.0.1")
+	checkpointPod.UID = "uid-3"
+	k.setPodResources(
+		newTestPod("pod-1", testResourceName, "10.0.0.1", "10.0.0.2"),
+		newTestPod("pod-2", testResourceName+"-camera", "10.0.0.1"),
+		// the checkpoint has no pod names
+		checkpointPod,
+	)
+
+	pods, err := devicePods(testResourceName, "10.0.0.1")
+	require.NoError(t, err)
+	require.Equal(t, []*v1.ObjectReference{{Kind: "Pod", Namespace: "default", Name: "pod-1"}}, pods)
+
+	pods, err = devicePods(testResourceName, "10.0.0.3")
+	require.NoError(t, err)
+	require.Empty(t, pods)
+}
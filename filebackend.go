@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"carizon-device-plugin/conf"
+	"carizon-device-plugin/pkg/logger"
+
+	"gopkg.in/yaml.v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const defaultInventoryDir = "/etc/carizon-device-plugin/"
+
+// fileInventory is the device inventory file of the file backend. JSON files
+// are read as well since JSON is a subset of YAML.
+type fileInventory struct {
+	Devices []fileDevice `yaml:"devices" json:"devices"`
+}
+
+// fileDevice is a device of the inventory file. Devices with a node only belong
+// to that node, the others to every node. A device with healthy set to false
+// is reported unhealthy.
+type fileDevice struct {
+	IP            string `yaml:"ip" json:"ip"`
+	UUID          int    `yaml:"uuid" json:"uuid"`
+	ChipType      string `yaml:"chip_type" json:"chip_type"`
+	SystemVersion string `yaml:"system_version" json:"system_version"`
+	Location      string `yaml:"location" json:"location"`
+	Tags          string `yaml:"tags" json:"tags"`
+	Node          string `yaml:"node" json:"node"`
+	Healthy       *bool  `yaml:"healthy" json:"healthy"`
+}
+
+// FileDeviceManager serves the devices listed in an inventory file, for the
+// clusters without cmdb. Allocations are only tracked by kubelet.
+type FileDeviceManager struct {
+	resource conf.Resource
+}
+
+// NewFileDeviceManager returns a new instance of FileDeviceManager
+func NewFileDeviceManager(resource conf.Resource) *FileDeviceManager {
+	return &FileDeviceManager{resource: resource}
+}
+
+func (m *FileDeviceManager) file() string {
+	if m.resource.File != "" {
+		return m.resource.File
+	}
+	return defaultInventoryDir + m.resource.ResourceName + ".yaml"
+}
+
+// nodeDevices reads the inventory file and returns the devices of the node
+func (m *FileDeviceManager) nodeDevices() ([]fileDevice, error) {
+	data, err := ioutil.ReadFile(m.file())
+	if err != nil {
+		return nil, err
+	}
+	var inventory fileInventory
+	if err := yaml.Unmarshal(data, &inventory); err != nil {
+		return nil, fmt.Errorf("invalid inventory file %s: %v", m.file(), err)
+	}
+
+	nodeName := m.resource.Filter.NodeName
+	if nodeName == "" {
+		nodeName = NodeName
+	}
+	var devices []fileDevice
+	for _, d := range inventory.Devices {
+		if d.IP == "" {
+			logger.Wrapper.Errorf("Skip device without ip in inventory file %s", m.file())
+			continue
+		}
+		if d.Node == "" || d.Node == nodeName {
+			devices = append(devices, d)
+		}
+	}
+	return devices, nil
+}
+
+// Devices returns the devices of the node in the inventory file
+func (m *FileDeviceManager) Devices() ([]*Device, error) {
+	devices, err := m.nodeDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	var devs []*Device
+	for _, d := range devices {
+		dev := buildDevice(&externalDevice{
+			UUID:          d.UUID,
+			IP:            d.IP,
+			ChipType:      d.ChipType,
+			SystemVersion: d.SystemVersion,
+			Location:      d.Location,
+			Tags:          d.Tags,
+		})
+		if d.Healthy != nil && !*d.Healthy {
+			dev.Health = pluginapi.Unhealthy
+		}
+		devs = append(devs, dev)
+	}
+	return devs, nil
+}
+
+// CheckHealth checks health of the devices against the inventory file and the
+// configured probes
+func (m *FileDeviceManager) CheckHealth(stop <-chan interface{}, devices []*Device, healthy, unhealthy chan<- *Device) {
+	interval := m.resource.HealthCheck.Interval
+	if interval <= 0 {
+		interval = healthCheckInterval
+	}
+	checks := append([]devicesHealthFunc{m.devicesHealth}, healthChecks(m.resource)...)
+	checkHealth(stop, devices, healthy, unhealthy, interval, combineHealth(checks...))
+}
+
+// devicesHealth reports the devices removed from the inventory file or marked
+// not healthy as unhealthy
+func (m *FileDeviceManager) devicesHealth(devices []*Device) (map[string]bool, error) {
+	listed, err := m.nodeDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]bool, len(listed))
+	for _, d := range listed {
+		found[d.IP] = d.Healthy == nil || *d.Healthy
+	}
+	health := make(map[string]bool, len(devices))
+	for _, d := range devices {
+		health[d.IP] = found[d.IP]
+	}
+	return health, nil
+}
+
+// GetAllocateDevicesInfo returns no pcie info, the inventory file has none
+func (m *FileDeviceManager) GetAllocateDevicesInfo(deviceIPs []string) (*[]PCIeAddressInfo, error) {
+	return &[]PCIeAddressInfo{}, nil
+}
+
+// Allocate does nothing, the allocations are tracked by kubelet
+func (m *FileDeviceManager) Allocate(deviceIPs []string, owner Reservation) []ReservationResult {
+	logger.Wrapper.Debugf("Allocate %s deviceIPs: %+v", m.resource.ResourceName, deviceIPs)
+	return nil
+}
+
+// Lease checks the devices are still in the inventory file and not marked unhealthy
+func (m *FileDeviceManager) Lease(deviceIPs []string) error {
+	health, err := m.devicesHealth(devicesOf(deviceIPs))
+	if err != nil {
+		return err
+	}
+	for _, ip := range deviceIPs {
+		if !health[ip] {
+			return fmt.Errorf("device %s is not available in inventory file %s", ip, m.file())
+		}
+	}
+	return nil
+}
+
+// Release does nothing, the allocations are tracked by kubelet
+func (m *FileDeviceManager) Release(deviceIPs []string) {
+	logger.Wrapper.Debugf("Release %s deviceIPs: %+v", m.resource.ResourceName, deviceIPs)
+}
+
+// Reserved returns no devices, the allocations are tracked by kubelet
+func (m *FileDeviceManager) Reserved() ([]string, error) {
+	return nil, nil
+}
+
+func devicesOf(deviceIPs []string) []*Device {
+	devices := make([]*Device, 0, len(deviceIPs))
+	for _, ip := range deviceIPs {
+		d := &Device{}
+		d.ID, d.IP = ip, ip
+		devices = append(devices, d)
+	}
+	return devices
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"carizon-device-plugin/conf"
+)
+
+const yamlInventory = `
+devices:
+  - ip: 10.0.0.1
+    uuid: 318
+    chip_type: J5
+    system_version: 1.2.0
+    location: rack-1
+    tags: camera,lab
+    node: node-1
+  - ip: 10.0.0.2
+    uuid: 319
+    healthy: false
+  - ip: 10.0.0.3
+    node: node-2
+  - uuid: 320
+`
+
+const jsonInventory = `{"devices": [
+	{"ip": "10.0.0.1", "uuid": 318, "chip_type": "J5", "system_version": "1.2.0", "location": "rack-1", "tags": "camera,lab", "node": "node-1"},
+	{"ip": "10.0.0.2", "uuid": 319, "healthy": false},
+	{"ip": "10.0.0.3", "node": "node-2"},
+	{"uuid": 320}
+]}`
+
+func writeInventory(t *testing.T, name, data string) string {
+	file := filepath.Join(t.TempDir(), name)
+	require.NoError(t, ioutil.WriteFile(file, []byte(data), 0644))
+	return file
+}
+
+func TestFileDevices(t *testing.T) {
+	want := []*Device{
+		buildDevice(&externalDevice{UUID: 318, IP: "10.0.0.1", ChipType: "J5", SystemVersion: "1.2.0", Location: "rack-1", Tags: "camera,lab"}),
+		buildDevice(&externalDevice{UUID: 319, IP: "10.0.0.2"}),
+	}
+	want[1].Health = pluginapi.Unhealthy
+
+	for _, tc := range []struct {
+		name string
+		file string
+		data string
+	}{
+		{"yaml", "J5.yaml", yamlInventory},
+		{"json", "J5.json", jsonInventory},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			file := writeInventory(t, tc.file, tc.data)
+			m := NewFileDeviceManager(conf.Resource{ResourceName: "J5", Backend: "file", File: file, Filter: conf.Filter{NodeName: "node-1"}})
+			devices, err := m.Devices()
+			require.NoError(t, err)
+			require.Equal(t, want, devices)
+
+			// the devices of other nodes are left out, the node defaults to the node of the plugin
+			prev := NodeName
+			NodeName = "node-2"
+			defer func() { NodeName = prev }()
+			m = NewFileDeviceManager(conf.Resource{ResourceName: "J5", Backend: "file", File: file})
+			devices, err = m.Devices()
+			require.NoError(t, err)
+			require.Len(t, devices, 2)
+			require.Equal(t, "10.0.0.2", devices[0].ID)
+			require.Equal(t, "10.0.0.3", devices[1].ID)
+		})
+	}
+}
+
+func TestFileInventoryPath(t *testing.T) {
+	m := NewFileDeviceManager(conf.Resource{ResourceName: "J5", Backend: "file"})
+	require.Equal(t, "/etc/carizon-device-plugin/J5.yaml", m.file())
+
+	m = NewFileDeviceManager(conf.Resource{ResourceName: "J5", Backend: "file", File: "/data/j5.json"})
+	require.Equal(t, "/data/j5.json", m.file())
+}
+
+func TestFileInventoryErrors(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "J5.yaml")
+	m := NewFileDeviceManager(conf.Resource{ResourceName: "J5", Backend: "file", File: missing})
+	_, err := m.Devices()
+	require.True(t, os.IsNotExist(err), "unexpected error %v", err)
+	require.Error(t, m.Lease([]string{"10.0.0.1"}))
+
+	m = NewFileDeviceManager(conf.Resource{ResourceName: "J5", Backend: "file", File: writeInventory(t, "J5.yaml", "devices: {")})
+	_, err = m.Devices()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid inventory file")
+}
+
+func TestFileLease(t *testing.T) {
+	m := NewFileDeviceManager(conf.Resource{ResourceName: "J5", Backend: "file",
+		File: writeInventory(t, "J5.yaml", yamlInventory), Filter: conf.Filter{NodeName: "node-1"}})
+
+	require.NoError(t, m.Lease([]string{"10.0.0.1"}))
+	// marked not healthy
+	require.Error(t, m.Lease([]string{"10.0.0.1", "10.0.0.2"}))
+	// listed for another node
+	require.Error(t, m.Lease([]string{"10.0.0.3"}))
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	httpclient "carizon-device-plugin/pkg/client"
+	"carizon-device-plugin/pkg/logger"
+	"carizon-device-plugin/pkg/mapstr"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// cmdbTimeLayout is the datetime layout used by cmdb instance attributes
+const cmdbTimeLayout = "2006-01-02 15:04:05"
+
+// devicesHealthFunc returns the health of the devices keyed by device IP.
+// Devices missing from the result keep their current health.
+type devicesHealthFunc func(devices []*Device) (map[string]bool, error)
+
+// CheckHealth checks health of the devices
+func (h *CarizonDeviceManager) CheckHealth(stop <-chan interface{}, devices []*Device, healthy, unhealthy chan<- *Device) {
+	interval := h.resource.HealthCheck.Interval
+	if interval <= 0 {
+		interval = healthCheckInterval
+	}
+	checks := append([]devicesHealthFunc{h.devicesHealth}, healthChecks(h.resource)...)
+	checkHealth(stop, devices, healthy, unhealthy, interval, combineHealth(checks...))
+}
+
+func (h *CarizonDeviceManager) devicesHealth(devices []*Device) (map[string]bool, error) {
+	if h.resource.HealthCheck.UseHealthyAPI {
+		return healthFromAPI(devices)
+	}
+
+	threshold := h.resource.HealthCheck.StaleThreshold
+	if threshold == 0 {
+		threshold = healthStaleThreshold
+	}
+	return healthFromInsts(h.deviceType, devices, threshold)
+}
+
+// checkHealth reports the devices whose health flipped on healthy and unhealthy.
+// The devices are owned by the health check, their health is the one last reported.
+func checkHealth(stop <-chan interface{}, devices []*Device, healthy, unhealthy chan<- *Device, interval time.Duration, devicesHealth devicesHealthFunc) {
+	healthCheck := strings.ToLower(os.Getenv(healthCheckEnv))
+	if healthCheck == "false" {
+		log.Printf("Disable device health checks")
+		return
+	}
+
+	for {
+		health, err := devicesHealth(devices)
+		if err != nil {
+			logger.Wrapper.Errorf("Error. Failed to get device health. %v", err)
+		}
+
+		for _, d := range devices {
+			isHealthy, ok := health[d.IP]
+			if !ok {
+				continue
+			}
+
+			var (
+				ch     chan<- *Device
+				health string
+			)
+			if !isHealthy && d.Health == pluginapi.Healthy {
+				log.Printf("Device %s become unhealthy", d.IP)
+				ch, health = unhealthy, pluginapi.Unhealthy
+			} else if isHealthy && d.Health == pluginapi.Unhealthy {
+				log.Printf("Device %s become healthy", d.IP)
+				ch, health = healthy, pluginapi.Healthy
+			}
+			if ch == nil {
+				continue
+			}
+
+			select {
+			case ch <- d:
+				d.Health = health
+			case <-stop:
+				return
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// healthFromInsts checks the status and last_alive_time attributes of the
+// device instances. Devices no longer found in cmdb are unhealthy.
+func healthFromInsts(objectID string, devices []*Device, staleThreshold time.Duration) (map[string]bool, error) {
+	ips := make([]string, 0, len(devices))
+	for _, d := range devices {
+		ips = append(ips, d.IP)
+	}
+	if len(ips) == 0 {
+		return nil, nil
+	}
+
+	insts, err := searchDeviceInsts(objectID, ips)
+	if err != nil {
+		return nil, err
+	}
+
+	health := make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		health[ip] = false
+	}
+	for _, inst := range insts {
+		ip, _ := inst.String(deviceFieldIP)
+		if _, ok := health[ip]; ok {
+			health[ip] = isInstHealthy(inst, staleThreshold)
+		}
+	}
+	return health, nil
+}
+
+// isInstHealthy reports whether a device instance is online and has been alive
+// within staleThreshold. A negative threshold disables the staleness check.
+func isInstHealthy(inst mapstr.MapStr, staleThreshold time.Duration) bool {
+	if status, err := inst.Int64(deviceFieldStatus); err == nil && status == int64(DeviceOffline) {
+		return false
+	}
+	if staleThreshold < 0 {
+		return true
+	}
+
+	lastAlive, ok := instTime(inst, deviceFieldLastAlive)
+	if !ok {
+		// the device never reported a heartbeat, trust its status
+		return true
+	}
+	return time.Since(lastAlive) <= staleThreshold
+}
+
+func instTime(inst mapstr.MapStr, key string) (time.Time, bool) {
+	if t, err := inst.Time(key); err == nil {
+		return *t, true
+	}
+	value, _ := inst.String(key)
+	t, err := time.ParseInLocation(cmdbTimeLayout, value, time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// healthFromAPI asks the cmdb healthy api of every device. Devices whose
+// health can not be fetched keep their current health.
+func healthFromAPI(devices []*Device) (map[string]bool, error) {
+	health := make(map[string]bool, len(devices))
+	for _, d := range devices {
+		result := CmdbApiClient.DoGet(context.Background(), CmdbServer+fmt.Sprintf(checkHealthAPI, d.UUID), httpclient.EmptyHeader, httpclient.EmptyQuery)
+		var ret HTTPRetBool
+		if err := result.Into(&ret); err != nil {
+			log.Printf("Error. Failed to get device %s healthy. %v", d.IP, err)
+			continue
+		}
+		if ret.Code != 0 {
+			log.Printf("Error. Invalid device %s healthy response: %s", d.IP, result.Body)
+			continue
+		}
+		health[d.IP] = ret.Data
+	}
+	return health, nil
+}
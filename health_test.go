@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"carizon-device-plugin/pkg/fakecmdb"
+	"carizon-device-plugin/pkg/mapstr"
+)
+
+func TestHealthFromAPI(t *testing.T) {
+	cmdb := newFakeCMDB(t)
+	host := cmdb.AddHost("node-1")
+	d1 := cmdb.AddDevice("J5", host, mapstr.MapStr{"ip": "10.0.0.1"})
+	d2 := cmdb.AddDevice("J5", host, mapstr.MapStr{"ip": "10.0.0.2"})
+	cmdb.SetHealthy(d2, false)
+
+	health, err := healthFromAPI([]*Device{newTestDevice(d1, "10.0.0.1"), newTestDevice(d2, "10.0.0.2")})
+	require.NoError(t, err)
+	require.Equal(t, map[string]bool{"10.0.0.1": true, "10.0.0.2": false}, health)
+	require.Equal(t, 2, cmdb.Requests(fakecmdb.APIDeviceHealthy))
+}
+
+func TestHealthFromAPIKeepsUnknownDevices(t *testing.T) {
+	cmdb := newFakeCMDB(t)
+	cmdb.FailResult(fakecmdb.APIDeviceHealthy, 1, "unavailable")
+
+	health, err := healthFromAPI([]*Device{newTestDevice(1, "10.0.0.1")})
+	require.NoError(t, err)
+	require.Empty(t, health)
+}
+
+func TestIsInstHealthy(t *testing.T) {
+	now := time.Now()
+	require.False(t, isInstHealthy(mapstr.MapStr{"status": DeviceOffline}, time.Minute))
+	require.True(t, isInstHealthy(mapstr.MapStr{"status": 0}, time.Minute))
+	require.True(t, isInstHealthy(mapstr.MapStr{"last_alive_time": now.Format(cmdbTimeLayout)}, time.Minute))
+	require.False(t, isInstHealthy(mapstr.MapStr{"last_alive_time": now.Add(-time.Hour).Format(cmdbTimeLayout)}, time.Minute))
+	require.True(t, isInstHealthy(mapstr.MapStr{"last_alive_time": now.Add(-time.Hour).Format(cmdbTimeLayout)}, -1))
+}
+
+func TestCheckHealthFlipsDevices(t *testing.T) {
+	devices := []*Device{newTestDevice(1, "10.0.0.1"), newTestDevice(2, "10.0.0.2")}
+	stop := make(chan interface{})
+	defer close(stop)
+	healthy, unhealthy := make(chan *Device), make(chan *Device)
+
+	go checkHealth(stop, devices, healthy, unhealthy, time.Hour, func([]*Device) (map[string]bool, error) {
+		return map[string]bool{"10.0.0.2": false}, nil
+	})
+
+	select {
+	case d := <-unhealthy:
+		require.Equal(t, "10.0.0.2", d.IP)
+	case d := <-healthy:
+		t.Fatalf("unexpected healthy device %s", d.IP)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no health flip")
+	}
+	require.Equal(t, pluginapi.Healthy, devices[0].Health)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"os"
+
+	"carizon-device-plugin/pkg/logger"
+	"carizon-device-plugin/pkg/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	httpAddrEnv     = "HTTP_ADDR"
+	defaultHTTPAddr = ":9410"
+	// the debug api exposes the config and allocations, so it only listens
+	// locally by default
+	debugAddrEnv     = "DEBUG_ADDR"
+	defaultDebugAddr = "127.0.0.1:9411"
+)
+
+// startHTTPServer serves the metrics and the debug api of the plugins
+func startHTTPServer(supervisor *PluginSupervisor) {
+	if err := prometheus.Register(pluginCollector{supervisor: supervisor}); err != nil {
+		logger.Wrapper.Errorf("[http] Register plugin collector error: %s", err.Error())
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	go serveHTTP("metrics", envOrDefault(httpAddrEnv, defaultHTTPAddr), mux)
+
+	debugMux := http.NewServeMux()
+	registerDebugHandlers(debugMux, supervisor)
+	go serveHTTP("debug api", envOrDefault(debugAddrEnv, defaultDebugAddr), debugMux)
+}
+
+// serveHTTP serves the handler on addr, it returns when the server fails
+func serveHTTP(name, addr string, handler http.Handler) {
+	logger.Wrapper.Infof("[http] Serving %s on %s", name, addr)
+	if err := http.ListenAndServe(addr, handler); err != nil {
+		logger.Wrapper.Errorf("[http] Serve %s error: %s", name, err.Error())
+	}
+}
+
+func envOrDefault(key, value string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return value
+}
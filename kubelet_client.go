@@ -1,6 +1,8 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"net/url"
 	"os"
 	"time"
@@ -8,9 +10,13 @@ import (
 	"carizon-device-plugin/pkg/logger"
 
 	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
+	podresourcesv1 "k8s.io/kubelet/pkg/apis/podresources/v1"
+	podresourcesv1alpha1 "k8s.io/kubelet/pkg/apis/podresources/v1alpha1"
 	"k8s.io/kubernetes/pkg/kubelet/apis/podresources"
-	podresourcesapi "k8s.io/kubernetes/pkg/kubelet/apis/podresources/v1alpha1"
 	"k8s.io/kubernetes/pkg/kubelet/util"
 )
 
@@ -18,21 +24,101 @@ const (
 	defaultKubeletSocketFile   = "kubelet.sock"
 	defaultPodResourcesMaxSize = 1024 * 1024 * 16 // 16 Mb
 	defaultPodResourcesPath    = "/var/lib/kubelet/pod-resources"
+
+	podResourcesV1       = "v1"
+	podResourcesV1alpha1 = "v1alpha1"
 )
 
+// PodResources are the devices assigned to the containers of a pod
+type PodResources struct {
+	Name      string `json:"name,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	// UID is only known from the checkpoint, which doesn't know the name and namespace
+	UID        string               `json:"uid,omitempty"`
+	Containers []ContainerResources `json:"containers"`
+}
+
+// ContainerResources are the devices assigned to a container
+type ContainerResources struct {
+	Name    string             `json:"name"`
+	Devices []ContainerDevices `json:"devices"`
+}
+
+// ContainerDevices are the devices of a resource assigned to a container
+type ContainerDevices struct {
+	ResourceName string   `json:"resource_name"`
+	DeviceIDs    []string `json:"device_ids"`
+}
+
+// owner returns the owner of the devices assigned to the container of the pod
+func (pr *PodResources) owner(container string) DeviceOwner {
+	return DeviceOwner{PodUID: pr.UID, PodName: pr.Name, PodNamespace: pr.Namespace, ContainerName: container}
+}
+
+// container returns the container of the pod, adding it when missing
+func (pr *PodResources) container(name string) *ContainerResources {
+	for i := range pr.Containers {
+		if pr.Containers[i].Name == name {
+			return &pr.Containers[i]
+		}
+	}
+	pr.Containers = append(pr.Containers, ContainerResources{Name: name})
+	return &pr.Containers[len(pr.Containers)-1]
+}
+
 // ResourceInfo is struct to hold Pod device allocation information
 type ResourceInfo struct {
-	Index     int
 	DeviceIDs []string
+	// Owners are the containers holding the devices, keyed by device ID
+	Owners map[string]DeviceOwner
+}
+
+// add adds the devices held by the owner
+func (r *ResourceInfo) add(ids []string, owner DeviceOwner) {
+	if r.Owners == nil {
+		r.Owners = make(map[string]DeviceOwner)
+	}
+	r.DeviceIDs = append(r.DeviceIDs, ids...)
+	for _, id := range ids {
+		r.Owners[id] = owner
+	}
+}
+
+// podResourceMap flattens the devices of the pods by resource name
+func podResourceMap(pods []PodResources) map[string]*ResourceInfo {
+	resourceMap := make(map[string]*ResourceInfo)
+	for i := range pods {
+		pr := &pods[i]
+		for _, cnt := range pr.Containers {
+			for _, dev := range cnt.Devices {
+				rInfo, ok := resourceMap[dev.ResourceName]
+				if !ok {
+					rInfo = &ResourceInfo{}
+					resourceMap[dev.ResourceName] = rInfo
+				}
+				rInfo.add(dev.DeviceIDs, pr.owner(cnt.Name))
+			}
+		}
+	}
+	return resourceMap
 }
 
 // ResourceClient provides a kubelet Pod resource handle
 type ResourceClient interface {
-	// GetPodResourceMap returns an instance of a map of Pod ResourceInfo given a (Pod name, namespace) tuple
+	// GetPodResources returns the devices assigned to the containers of every pod
+	GetPodResources() ([]PodResources, error)
+	// GetPodResourceMap returns the devices held by pods keyed by resource name
 	GetPodResourceMap() (map[string]*ResourceInfo, error)
+	// GetAllocatableDevices returns the device IDs kubelet can allocate keyed by resource name
+	GetAllocatableDevices() (map[string][]string, error)
 }
 
-// GetResourceClient get initialized with Pod resource information
+// errAllocatableUnavailable is returned by the clients which can't tell the allocatable devices
+var errAllocatableUnavailable = errors.New("allocatable devices are not available")
+
+// GetResourceClient get initialized with Pod resource information. The kubelet pod
+// resources api v1 is used by default, v1alpha1 on older kubelets, and the
+// checkpoint file when the api is unavailable.
 func GetResourceClient(kubeletSocket string) (ResourceClient, error) {
 	if kubeletSocket == "" {
 		kubeletSocket, _ = util.LocalEndpoint(defaultPodResourcesPath, podresources.Socket)
@@ -40,71 +126,184 @@ func GetResourceClient(kubeletSocket string) (ResourceClient, error) {
 	logger.Wrapper.Infof("[GetResourceClient]: using Kubelet resource API endpoint")
 	// If Kubelet resource API endpoint exist use that by default
 	if hasKubeletAPIEndpoint(kubeletSocket) {
-		return getKubeletClient(kubeletSocket)
+		client, err := getKubeletClient(kubeletSocket)
+		if err == nil {
+			return client, nil
+		}
+		logger.Wrapper.Errorf("[GetResourceClient]: kubelet resource api error, falling back to checkpoint: %v", err)
 	}
 
 	return GetCheckpoint()
 }
 
-// getKubeletClient ...
+// kubeletPodResources returns the devices assigned to the containers of every
+// pod, it is replaced by the tests
+var kubeletPodResources = func() ([]PodResources, error) {
+	client, err := GetResourceClient("")
+	if err != nil {
+		return nil, err
+	}
+	return client.GetPodResources()
+}
+
+// getKubeletClient lists the pod resources with the v1 api, or the v1alpha1 api
+// when kubelet doesn't implement v1. Other v1 errors are returned, a kubelet
+// serving v1 doesn't serve the pods any better through v1alpha1.
 func getKubeletClient(kubeletSocket string) (ResourceClient, error) {
 	newClient := &kubeletClient{}
 	if kubeletSocket == "" {
 		kubeletSocket, _ = util.LocalEndpoint(defaultPodResourcesPath, podresources.Socket)
 	}
 
-	client, conn, err := podresources.GetClient(kubeletSocket, 10*time.Second, defaultPodResourcesMaxSize)
+	conn, err := dialPodResources(kubeletSocket, 10*time.Second, defaultPodResourcesMaxSize)
 	if err != nil {
 		logger.Wrapper.Errorf("[getKubeletClient]: get grpc client error: %v\n", err)
 		return nil, err
 	}
 	defer conn.Close()
 
+	client := podresourcesv1.NewPodResourcesListerClient(conn)
 	if err := newClient.getPodResources(client); err != nil {
-		logger.Wrapper.Errorf("[getKubeletClient]: get pod resources from client error: %v\n", err)
-		return nil, err
+		if status.Code(err) != codes.Unimplemented {
+			return nil, err
+		}
+		logger.Wrapper.Infof("[getKubeletClient]: pod resources api v1 unimplemented, trying v1alpha1: %v", err)
+		if err := newClient.getPodResourcesV1alpha1(podresourcesv1alpha1.NewPodResourcesListerClient(conn)); err != nil {
+			logger.Wrapper.Errorf("[getKubeletClient]: get pod resources from client error: %v\n", err)
+			return nil, err
+		}
+	} else {
+		newClient.getAllocatableResources(client)
 	}
+	logger.Wrapper.Infof("[getKubeletClient]: listed pod resources with api %s", newClient.version)
 
 	return newClient, nil
 }
 
-// kubeletClient ...
+// dialPodResources connects to the kubelet pod resources socket
+func dialPodResources(socket string, connectionTimeout time.Duration, maxMsgSize int) (*grpc.ClientConn, error) {
+	addr, dialer, err := util.GetAddressAndDialer(socket)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), connectionTimeout)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, addr, grpc.WithInsecure(), grpc.WithContextDialer(dialer), grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(maxMsgSize)))
+	if err != nil {
+		return nil, fmt.Errorf("error dialing socket %s: %v", socket, err)
+	}
+	return conn, nil
+}
+
+// kubeletClient holds the pod resources listed from kubelet, converted to v1
+// when listed with v1alpha1
 type kubeletClient struct {
-	resources []*podresourcesapi.PodResources
+	// version is the pod resources api version used
+	version     string
+	resources   []*podresourcesv1.PodResources
+	allocatable map[string][]string
 }
 
-// getPodResources ...
-func (rc *kubeletClient) getPodResources(client podresourcesapi.PodResourcesListerClient) error {
+// getPodResources lists the pod resources with the v1 api
+func (rc *kubeletClient) getPodResources(client podresourcesv1.PodResourcesListerClient) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	resp, err := client.List(ctx, &podresourcesapi.ListPodResourcesRequest{})
+	resp, err := client.List(ctx, &podresourcesv1.ListPodResourcesRequest{})
 	if err != nil {
 		logger.Wrapper.Errorf("[getPodResources]: failed to list pod resources, %v.Get(_) = _, %v", client, err)
 		return err
 	}
 
+	rc.version = podResourcesV1
 	rc.resources = resp.PodResources
 	return nil
 }
 
-// GetPodResourceMap ...
-func (rc *kubeletClient) GetPodResourceMap() (map[string]*ResourceInfo, error) {
-	resourceMap := make(map[string]*ResourceInfo)
+// getPodResourcesV1alpha1 lists the pod resources with the v1alpha1 api
+func (rc *kubeletClient) getPodResourcesV1alpha1(client podresourcesv1alpha1.PodResourcesListerClient) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resp, err := client.List(ctx, &podresourcesv1alpha1.ListPodResourcesRequest{})
+	if err != nil {
+		logger.Wrapper.Errorf("[getPodResourcesV1alpha1]: failed to list pod resources, %v.Get(_) = _, %v", client, err)
+		return err
+	}
+
+	rc.version = podResourcesV1alpha1
+	rc.resources = convertPodResources(resp.PodResources)
+	return nil
+}
+
+// getAllocatableResources gets the allocatable devices with the v1 api, kubelet
+// serves them from 1.21 on behind the KubeletPodResourcesGetAllocatable feature gate
+func (rc *kubeletClient) getAllocatableResources(client podresourcesv1.PodResourcesListerClient) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resp, err := client.GetAllocatableResources(ctx, &podresourcesv1.AllocatableResourcesRequest{})
+	if err != nil {
+		logger.Wrapper.Infof("[getAllocatableResources]: allocatable resources unavailable: %v", err)
+		return
+	}
 
+	rc.allocatable = make(map[string][]string)
+	for _, dev := range resp.Devices {
+		rc.allocatable[dev.ResourceName] = append(rc.allocatable[dev.ResourceName], dev.DeviceIds...)
+	}
+}
+
+// convertPodResources converts the v1alpha1 pod resources to v1
+func convertPodResources(resources []*podresourcesv1alpha1.PodResources) []*podresourcesv1.PodResources {
+	converted := make([]*podresourcesv1.PodResources, 0, len(resources))
+	for _, pr := range resources {
+		pod := &podresourcesv1.PodResources{Name: pr.Name, Namespace: pr.Namespace}
+		for _, cnt := range pr.Containers {
+			container := &podresourcesv1.ContainerResources{Name: cnt.Name}
+			for _, dev := range cnt.Devices {
+				container.Devices = append(container.Devices, &podresourcesv1.ContainerDevices{ResourceName: dev.ResourceName, DeviceIds: dev.DeviceIds})
+			}
+			pod.Containers = append(pod.Containers, container)
+		}
+		converted = append(converted, pod)
+	}
+	return converted
+}
+
+// GetPodResources returns the pods listed from kubelet
+func (rc *kubeletClient) GetPodResources() ([]PodResources, error) {
+	pods := make([]PodResources, 0, len(rc.resources))
 	for _, pr := range rc.resources {
+		pod := PodResources{Name: pr.Name, Namespace: pr.Namespace, Containers: []ContainerResources{}}
 		for _, cnt := range pr.Containers {
+			container := ContainerResources{Name: cnt.Name, Devices: []ContainerDevices{}}
 			for _, dev := range cnt.Devices {
-				if rInfo, ok := resourceMap[dev.ResourceName]; ok {
-					rInfo.DeviceIDs = append(rInfo.DeviceIDs, dev.DeviceIds...)
-				} else {
-					resourceMap[dev.ResourceName] = &ResourceInfo{DeviceIDs: dev.DeviceIds}
-				}
+				container.Devices = append(container.Devices, ContainerDevices{ResourceName: dev.ResourceName, DeviceIDs: dev.DeviceIds})
 			}
+			pod.Containers = append(pod.Containers, container)
 		}
+		pods = append(pods, pod)
+	}
+	return pods, nil
+}
+
+// GetPodResourceMap ...
+func (rc *kubeletClient) GetPodResourceMap() (map[string]*ResourceInfo, error) {
+	pods, err := rc.GetPodResources()
+	if err != nil {
+		return nil, err
 	}
+	return podResourceMap(pods), nil
+}
 
-	return resourceMap, nil
+// GetAllocatableDevices returns the allocatable devices, only known with the v1 api
+func (rc *kubeletClient) GetAllocatableDevices() (map[string][]string, error) {
+	if rc.allocatable == nil {
+		return nil, errAllocatableUnavailable
+	}
+	return rc.allocatable, nil
 }
 
 // hasKubeletAPIEndpoint ...
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	podresourcesv1 "k8s.io/kubelet/pkg/apis/podresources/v1"
+	podresourcesv1alpha1 "k8s.io/kubelet/pkg/apis/podresources/v1alpha1"
+)
+
+// fakePodResources serves the kubelet pod resources api of one version
+type fakePodResources struct {
+	podresourcesv1.UnimplementedPodResourcesListerServer
+	allocatable bool
+	listErr     error
+}
+
+func (f *fakePodResources) List(ctx context.Context, r *podresourcesv1.ListPodResourcesRequest) (*podresourcesv1.ListPodResourcesResponse, error) {
+	if f.listErr != nil {
+		return nil, f.listErr
+	}
+	return &podresourcesv1.ListPodResourcesResponse{PodResources: []*podresourcesv1.PodResources{{
+		Name:       "train-0",
+		Namespace:  "ml",
+		Containers: []*podresourcesv1.ContainerResources{{Name: "worker", Devices: []*podresourcesv1.ContainerDevices{{ResourceName: "J5", DeviceIds: []string{"10.0.0.1"}}}}},
+	}}}, nil
+}
+
+func (f *fakePodResources) GetAllocatableResources(ctx context.Context, r *podresourcesv1.AllocatableResourcesRequest) (*podresourcesv1.AllocatableResourcesResponse, error) {
+	if !f.allocatable {
+		return f.UnimplementedPodResourcesListerServer.GetAllocatableResources(ctx, r)
+	}
+	return &podresourcesv1.AllocatableResourcesResponse{Devices: []*podresourcesv1.ContainerDevices{
+		{ResourceName: "J5", DeviceIds: []string{"10.0.0.1"}},
+		{ResourceName: "J5", DeviceIds: []string{"10.0.0.2"}},
+	}}, nil
+}
+
+type fakePodResourcesV1alpha1 struct{}
+
+func (f fakePodResourcesV1alpha1) List(ctx context.Context, r *podresourcesv1alpha1.ListPodResourcesRequest) (*podresourcesv1alpha1.ListPodResourcesResponse, error) {
+	return &podresourcesv1alpha1.ListPodResourcesResponse{PodResources: []*podresourcesv1alpha1.PodResources{{
+		Name:       "train-0",
+		Namespace:  "ml",
+		Containers: []*podresourcesv1alpha1.ContainerResources{{Name: "worker", Devices: []*podresourcesv1alpha1.ContainerDevices{{ResourceName: "J5", DeviceIds: []string{"10.0.0.1"}}}}},
+	}}}, nil
+}
+
+// servePodResources serves the pod resources api on a temporary socket and returns its endpoint
+func servePodResources(t *testing.T, register func(s *grpc.Server)) string {
+	// unix socket paths are limited to 108 bytes, keep the directory short
+	dir, err := ioutil.TempDir("", "podres")
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	register(server)
+	sock, err := net.Listen("unix", filepath.Join(dir, "kubelet.sock"))
+	require.NoError(t, err)
+	go server.Serve(sock)
+	t.Cleanup(func() {
+		server.Stop()
+		os.RemoveAll(dir)
+	})
+	return "unix://" + filepath.Join(dir, "kubelet.sock")
+}
+
+func TestResourceClientNegotiatesVersion(t *testing.T) {
+	owner := DeviceOwner{PodName: "train-0", PodNamespace: "ml", ContainerName: "worker"}
+
+	for _, tc := range []struct {
+		name        string
+		register    func(s *grpc.Server)
+		version     string
+		allocatable map[string][]string
+	}{
+		{"v1", func(s *grpc.Server) {
+			podresourcesv1.RegisterPodResourcesListerServer(s, &fakePodResources{allocatable: true})
+		}, podResourcesV1, map[string][]string{"J5": {"10.0.0.1", "10.0.0.2"}}},
+		{"v1 without allocatable", func(s *grpc.Server) {
+			podresourcesv1.RegisterPodResourcesListerServer(s, &fakePodResources{})
+		}, podResourcesV1, nil},
+		{"v1alpha1", func(s *grpc.Server) {
+			podresourcesv1alpha1.RegisterPodResourcesListerServer(s, fakePodResourcesV1alpha1{})
+		}, podResourcesV1alpha1, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, err := GetResourceClient(servePodResources(t, tc.register))
+			require.NoError(t, err)
+			kc, ok := client.(*kubeletClient)
+			require.True(t, ok)
+			require.Equal(t, tc.version, kc.version)
+
+			resources, err := client.GetPodResourceMap()
+			require.NoError(t, err)
+			require.Equal(t, []string{"10.0.0.1"}, resources["J5"].DeviceIDs)
+			require.Equal(t, owner, resources["J5"].Owners["10.0.0.1"])
+
+			allocatable, err := client.GetAllocatableDevices()
+			if tc.allocatable == nil {
+				require.Equal(t, errAllocatableUnavailable, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.allocatable, allocatable)
+		})
+	}
+}
+
+func TestKubeletClientV1Error(t *testing.T) {
+	// only a kubelet without the v1 api is asked through v1alpha1
+	_, err := getKubeletClient(servePodResources(t, func(s *grpc.Server) {
+		podresourcesv1.RegisterPodResourcesListerServer(s, &fakePodResources{listErr: status.Error(codes.Unavailable, "kubelet is restarting")})
+		podresourcesv1alpha1.RegisterPodResourcesListerServer(s, fakePodResourcesV1alpha1{})
+	}))
+	require.Error(t, err)
+	require.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestResourceClientFallsBackToCheckpoint(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "kubelet_internal_checkpoint")
+	require.NoError(t, ioutil.WriteFile(file, []byte(`{"Data": {"PodDeviceEntries": [], "RegisteredDevices": {"J5": ["10.0.0.1"]}}}`), 0644))
+	prev := checkPointfile
+	checkPointfile = file
+	defer func() { checkPointfile = prev }()
+
+	// the socket exists but serves no pod resources api
+	client, err := GetResourceClient(servePodResources(t, func(s *grpc.Server) {}))
+	require.NoError(t, err)
+	_, ok := client.(*checkpoint)
+	require.True(t, ok)
+
+	allocatable, err := client.GetAllocatableDevices()
+	require.NoError(t, err)
+	require.Equal(t, map[string][]string{"J5": {"10.0.0.1"}}, allocatable)
+}
+
+func TestKubeletClientPodResourceMap(t *testing.T) {
+	client := &kubeletClient{resources: []*podresourcesv1.PodResources{{
+		Name:      "train-0",
+		Namespace: "ml",
+		Containers: []*podresourcesv1.ContainerResources{
+			{Name: "worker", Devices: []*podresourcesv1.ContainerDevices{{ResourceName: "J5", DeviceIds: []string{"10.0.0.1", "10.0.0.2"}}}},
+			{Name: "sidecar", Devices: []*podresourcesv1.ContainerDevices{{ResourceName: "J5", DeviceIds: []string{"10.0.0.3"}}}},
+		},
+	}}}
+
+	pods, err := client.GetPodResources()
+	require.NoError(t, err)
+	require.Equal(t, []PodResources{{Name: "train-0", Namespace: "ml", Containers: []ContainerResources{
+		{Name: "worker", Devices: []ContainerDevices{{ResourceName: "J5", DeviceIDs: []string{"10.0.0.1", "10.0.0.2"}}}},
+		{Name: "sidecar", Devices: []ContainerDevices{{ResourceName: "J5", DeviceIDs: []string{"10.0.0.3"}}}},
+	}}}, pods)
+
+	resources, err := client.GetPodResourceMap()
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, resources["J5"].DeviceIDs)
+	require.Equal(t, DeviceOwner{PodName: "train-0", PodNamespace: "ml", ContainerName: "worker"}, resources["J5"].Owners["10.0.0.2"])
+	require.Equal(t, "sidecar", resources["J5"].Owners["10.0.0.3"].ContainerName)
+}
+
+func TestCheckpointPodResourceMap(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "kubelet_internal_checkpoint")
+	require.NoError(t, ioutil.WriteFile(file, []byte(`{"Data": {"PodDeviceEntries": [
+		{"PodUID": "uid-1", "ContainerName": "worker", "ResourceName": "J5", "DeviceIDs": ["10.0.0.1"]},
+		{"PodUID": "uid-2", "ContainerName": "worker", "ResourceName": "J5", "DeviceIDs": ["10.0.0.2"]},
+		{"PodUID": "uid-1", "ContainerName": "worker", "ResourceName": "J5-camera", "DeviceIDs": ["10.0.0.3"]}
+	]}}`), 0644))
+
+	client, err := getCheckpoint(file)
+	require.NoError(t, err)
+	pods, err := client.GetPodResources()
+	require.NoError(t, err)
+	require.Equal(t, []PodResources{
+		{UID: "uid-1", Containers: []ContainerResources{{Name: "worker", Devices: []ContainerDevices{
+			{ResourceName: "J5", DeviceIDs: []string{"10.0.0.1"}},
+			{ResourceName: "J5-camera", DeviceIDs: []string{"10.0.0.3"}},
+		}}}},
+		{UID: "uid-2", Containers: []ContainerResources{{Name: "worker", Devices: []ContainerDevices{
+			{ResourceName: "J5", DeviceIDs: []string{"10.0.0.2"}},
+		}}}},
+	}, pods)
+
+	resources, err := client.GetPodResourceMap()
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, resources["J5"].DeviceIDs)
+	require.Equal(t, DeviceOwner{PodUID: "uid-2", ContainerName: "worker"}, resources["J5"].Owners["10.0.0.2"])
+}
+
+func TestCheckpointDeviceIDsPerNUMA(t *testing.T) {
+	// kubelet 1.20+ checkpoint, the devices are per NUMA node
+	file := filepath.Join(t.TempDir(), "kubelet_internal_checkpoint")
+	require.NoError(t, ioutil.WriteFile(file, []byte(`{"Data": {"PodDeviceEntries": [
+		{"PodUID": "uid-1", "ContainerName": "worker", "ResourceName": "J5", "DeviceIDs": {"1": ["10.0.0.3"], "0": ["10.0.0.1", "10.0.0.2"]}, "AllocResp": "CgA="},
+		{"PodUID": "uid-2", "ContainerName": "worker", "ResourceName": "J5", "DeviceIDs": {"0": ["10.0.0.4"], "1": ["10.0.0.4"]}, "AllocResp": "CgA="},
+		{"PodUID": "uid-3", "ContainerName": "worker", "ResourceName": "J5", "DeviceIDs": {}, "AllocResp": "CgA="}
+	], "RegisteredDevices": {"J5": ["10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"]}}, "Checksum": 1829471943}`), 0644))
+
+	client, err := getCheckpoint(file)
+	require.NoError(t, err)
+	resources, err := client.GetPodResourceMap()
+	require.NoError(t, err)
+	// a device of several NUMA nodes is held once
+	require.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}, resources["J5"].DeviceIDs)
+	require.Equal(t, "uid-1", resources["J5"].Owners["10.0.0.3"].PodUID)
+	require.Equal(t, "uid-2", resources["J5"].Owners["10.0.0.4"].PodUID)
+
+	require.NoError(t, ioutil.WriteFile(file, []byte(`{"Data": {"PodDeviceEntries": [
+		{"PodUID": "uid-1", "ContainerName": "worker", "ResourceName": "J5", "DeviceIDs": "10.0.0.1"}
+	]}}`), 0644))
+	_, err = getCheckpoint(file)
+	require.Error(t, err)
+}
+
+func TestReserveDevicesByOwner(t *testing.T) {
+	prev := NodeName
+	NodeName = "node-1"
+	defer func() { NodeName = prev }()
+
+	worker := DeviceOwner{PodName: "train-0", PodNamespace: "ml", ContainerName: "worker"}
+	info := &ResourceInfo{}
+	info.add([]string{"10.0.0.1"}, worker)
+	info.add([]string{"10.0.0.2"}, DeviceOwner{PodName: "train-1", PodNamespace: "ml", ContainerName: "worker"})
+	info.add([]string{"10.0.0.3"}, worker)
+
+	m := newStubManager()
+	reserveDevices(map[string]ResourceManager{"J5": m}, map[string]*ResourceInfo{"J5": info, "other": info})
+	require.Equal(t, [][]string{{"10.0.0.1", "10.0.0.3"}, {"10.0.0.2"}}, m.allocated)
+	require.Equal(t, Reservation{Node: "node-1", DeviceOwner: worker}, m.owners[0])
+	require.Equal(t, "train-1", m.owners[1].PodName)
+}
+
+func TestReleaseDevices(t *testing.T) {
+	resourceName := resourceDomain + "J5"
+	held := func(ids ...string) map[string]*ResourceInfo {
+		return map[string]*ResourceInfo{resourceName: {DeviceIDs: ids}}
+	}
+	missing := func(ids ...string) map[string][]string {
+		return map[string][]string{resourceName: ids}
+	}
+
+	for _, tc := range []struct {
+		name              string
+		pending           map[string][]string
+		previous, current map[string]*ResourceInfo
+		released          [][]string
+		next              map[string][]string
+	}{
+		{"no change", nil, held("10.0.0.1"), held("10.0.0.1"), nil, map[string][]string{}},
+		{"pod terminated", nil, held("10.0.0.1", "10.0.0.2", "10.0.0.3"), held("10.0.0.2"), nil, missing("10.0.0.1", "10.0.0.3")},
+		{"still missing", missing("10.0.0.1", "10.0.0.3"), held("10.0.0.2"), held("10.0.0.2"), [][]string{{"10.0.0.1", "10.0.0.3"}}, map[string][]string{}},
+		{"empty snapshot", nil, held("10.0.0.1", "10.0.0.2"), map[string]*ResourceInfo{}, nil, missing("10.0.0.1", "10.0.0.2")},
+		{"held again after an empty snapshot", missing("10.0.0.1", "10.0.0.2"), map[string]*ResourceInfo{}, held("10.0.0.1", "10.0.0.2"), nil, map[string][]string{}},
+		{"partial snapshot", missing("10.0.0.1", "10.0.0.2"), held("10.0.0.3"), held("10.0.0.1", "10.0.0.3"), [][]string{{"10.0.0.2"}}, map[string][]string{}},
+		{"new pod", nil, held("10.0.0.1"), held("10.0.0.1", "10.0.0.2"), nil, map[string][]string{}},
+		{"other device plugin", map[string][]string{"nvidia.com/gpu": {"gpu-1"}}, map[string]*ResourceInfo{"nvidia.com/gpu": {DeviceIDs: []string{"gpu-0"}}}, map[string]*ResourceInfo{}, nil, map[string][]string{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newStubManager()
+			next := releaseDevices(map[string]ResourceManager{resourceName: m}, tc.pending, tc.previous, tc.current)
+			require.Equal(t, tc.released, m.released)
+			require.Equal(t, tc.next, next)
+		})
+	}
+}
+
+func TestReleaseDevicesAfterRestart(t *testing.T) {
+	lastPodResources.set(nil, nil, nil)
+	defer lastPodResources.set(nil, nil, nil)
+
+	resourceName := resourceDomain + "J5"
+	m := newStubManager()
+	m.reserved = []string{"10.0.0.1", "10.0.0.2"}
+	other := newStubManager()
+	other.reserved = []string{"10.0.1.1"}
+	managers := map[string]ResourceManager{resourceName: m, "J5": other}
+
+	// after a restart the reservations of this node in the backend are the previous snapshot
+	previous := previousPodResources(managers)
+	require.Equal(t, map[string]*ResourceInfo{resourceName: {DeviceIDs: []string{"10.0.0.1", "10.0.0.2"}}}, previous)
+	current := map[string]*ResourceInfo{resourceName: {DeviceIDs: []string{"10.0.0.2"}}}
+	pending := releaseDevices(managers, nil, previous, current)
+	require.Empty(t, m.released)
+	lastPodResources.set(nil, current, pending)
+	require.Equal(t, current, previousPodResources(managers))
+
+	// released once the next snapshot confirms the pod is gone
+	releaseDevices(managers, lastPodResources.pendingRelease(), previousPodResources(managers), current)
+	require.Equal(t, [][]string{{"10.0.0.1"}}, m.released)
+	require.Empty(t, other.released)
+
+	lastPodResources.set(nil, nil, nil)
+	m.setError(errors.New("cmdb unavailable"))
+	require.Empty(t, previousPodResources(managers))
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"carizon-device-plugin/conf"
+)
+
+const (
+	testResourceName = "carizon.io/test"
+	testDeviceEnv    = "CARIZON_TEST_DEVICES"
+	testTimeout      = 10 * time.Second
+)
+
+// fakeKubelet serves the kubelet Registration service on a unix socket in a
+// temporary device plugin directory and talks to the registered plugins as
+// kubelet does
+type fakeKubelet struct {
+	dir        string
+	server     *grpc.Server
+	registered chan *pluginapi.RegisterRequest
+
+	// podResources are the devices assigned to the pods
+	podResourcesLock sync.Mutex
+	podResources     []PodResources
+	podResourcesErr  error
+}
+
+// newFakeKubelet starts a fake kubelet and points the plugins to it for the test
+func newFakeKubelet(t *testing.T) *fakeKubelet {
+	// unix socket paths are limited to 108 bytes, keep the directory short
+	dir, err := ioutil.TempDir("", "kubelet")
+	require.NoError(t, err)
+
+	k := &fakeKubelet{
+		dir:        dir,
+		server:     grpc.NewServer(),
+		registered: make(chan *pluginapi.RegisterRequest, 16),
+	}
+	pluginapi.RegisterRegistrationServer(k.server, k)
+
+	sock, err := net.Listen("unix", k.socket("kubelet.sock"))
+	require.NoError(t, err)
+	go k.server.Serve(sock)
+
+	prevSocket, prevPath, prevPodResources := kubeletSocket, devicePluginPath, kubeletPodResources
+	kubeletSocket, devicePluginPath = k.socket("kubelet.sock"), dir+string(filepath.Separator)
+	kubeletPodResources = k.getPodResources
+	t.Cleanup(func() {
+		kubeletSocket, devicePluginPath, kubeletPodResources = prevSocket, prevPath, prevPodResources
+		k.server.Stop()
+		os.RemoveAll(dir)
+	})
+	return k
+}
+
+// Register implements the kubelet Registration service
+func (k *fakeKubelet) Register(ctx context.Context, r *pluginapi.RegisterRequest) (*pluginapi.Empty, error) {
+	k.registered <- r
+	return &pluginapi.Empty{}, nil
+}
+
+func (k *fakeKubelet) setPodResources(pods ...PodResources) {
+	k.podResourcesLock.Lock()
+	defer k.podResourcesLock.Unlock()
+	k.podResources = pods
+}
+
+// setPodResourcesError fails listing the pod resources
+func (k *fakeKubelet) setPodResourcesError(err error) {
+	k.podResourcesLock.Lock()
+	defer k.podResourcesLock.Unlock()
+	k.podResourcesErr = err
+}
+
+func (k *fakeKubelet) getPodResources() ([]PodResources, error) {
+	k.podResourcesLock.Lock()
+	defer k.podResourcesLock.Unlock()
+	if k.podResourcesErr != nil {
+		return nil, k.podResourcesErr
+	}
+	return append([]PodResources{}, k.podResources...), nil
+}
+
+// newTestPod returns a pod in the default namespace whose main container holds the devices of the resource
+func newTestPod(name, resourceName string, ids ...string) PodResources {
+	return PodResources{Name: name, Namespace: "default", UID: name + "-uid", Containers: []ContainerResources{
+		{Name: "main", Devices: []ContainerDevices{{ResourceName: resourceName, DeviceIDs: ids}}},
+	}}
+}
+
+func (k *fakeKubelet) socket(name string) string {
+	return filepath.Join(k.dir, name)
+}
+
+// waitRegistered waits for the next registration
+func (k *fakeKubelet) waitRegistered(t *testing.T) *pluginapi.RegisterRequest {
+	select {
+	case r := <-k.registered:
+		return r
+	case <-time.After(testTimeout):
+		t.Fatal("plugin did not register")
+		return nil
+	}
+}
+
+// connect connects to the plugin endpoint of the registration
+func (k *fakeKubelet) connect(t *testing.T, r *pluginapi.RegisterRequest) pluginapi.DevicePluginClient {
+	conn, err := grpc.Dial(k.socket(r.Endpoint), grpc.WithInsecure(), grpc.WithBlock(),
+		grpc.WithTimeout(testTimeout),
+		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", addr, timeout)
+		}),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return pluginapi.NewDevicePluginClient(conn)
+}
+
+// watch opens a ListAndWatch stream, the device lists are sent on the returned
+// channel which is closed when the stream ends
+func (k *fakeKubelet) watch(t *testing.T, client pluginapi.DevicePluginClient) <-chan []*pluginapi.Device {
+	stream, err := client.ListAndWatch(context.Background(), &pluginapi.Empty{})
+	require.NoError(t, err)
+
+	updates := make(chan []*pluginapi.Device, 16)
+	go func() {
+		defer close(updates)
+		for {
+			resp, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			updates <- resp.Devices
+		}
+	}()
+	return updates
+}
+
+// nextUpdate waits for the next device list of the stream
+func nextUpdate(t *testing.T, updates <-chan []*pluginapi.Device) map[string]string {
+	select {
+	case devices, ok := <-updates:
+		require.True(t, ok, "ListAndWatch stream closed")
+		health := make(map[string]string, len(devices))
+		for _, d := range devices {
+			health[d.ID] = d.Health
+		}
+		return health
+	case <-time.After(testTimeout):
+		t.Fatal("no ListAndWatch update")
+		return nil
+	}
+}
+
+// stubManager is a ResourceManager serving a fixed device list, whose device
+// health is flipped by the test
+type stubManager struct {
+	sync.Mutex
+	ips       []string
+	err       error
+	allocated [][]string
+	owners    []Reservation
+	reserved  []string
+	released  [][]string
+	vnetIPs   map[string]string
+	flips     chan healthFlip
+}
+
+type healthFlip struct {
+	ip      string
+	healthy bool
+}
+
+func newStubManager(ips ...string) *stubManager {
+	return &stubManager{ips: ips, flips: make(chan healthFlip)}
+}
+
+func (m *stubManager) setError(err error) {
+	m.Lock()
+	defer m.Unlock()
+	m.err = err
+}
+
+func (m *stubManager) Devices() ([]*Device, error) {
+	m.Lock()
+	defer m.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	var devices []*Device
+	for i, ip := range m.ips {
+		devices = append(devices, newTestDevice(int64(i+1), ip))
+	}
+	return devices, nil
+}
+
+func (m *stubManager) CheckHealth(stop <-chan interface{}, devices []*Device, healthy, unhealthy chan<- *Device) {
+	for {
+		select {
+		case <-stop:
+			return
+		case f := <-m.flips:
+			for _, d := range devices {
+				if d.IP != f.ip {
+					continue
+				}
+				if f.healthy {
+					healthy <- d
+				} else {
+					unhealthy <- d
+				}
+			}
+		}
+	}
+}
+
+// flip reports the health of the device through the running health check
+func (m *stubManager) flip(t *testing.T, ip string, healthy bool) {
+	select {
+	case m.flips <- healthFlip{ip: ip, healthy: healthy}:
+	case <-time.After(testTimeout):
+		t.Fatal("health check is not running")
+	}
+}
+
+func (m *stubManager) GetAllocateDevicesInfo(deviceIPs []string) (*[]PCIeAddressInfo, error) {
+	info := []PCIeAddressInfo{}
+	for _, ip := range deviceIPs {
+		if vnetIP, ok := m.vnetIPs[ip]; ok {
+			info = append(info, PCIeAddressInfo{IP: ip, VNetIP: vnetIP})
+		}
+	}
+	return &info, nil
+}
+
+func (m *stubManager) Allocate(deviceIPs []string, owner Reservation) []ReservationResult {
+	m.Lock()
+	defer m.Unlock()
+	m.allocated = append(m.allocated, deviceIPs)
+	m.owners = append(m.owners, owner)
+	return nil
+}
+
+func (m *stubManager) Lease(deviceIPs []string) error {
+	return nil
+}
+
+func (m *stubManager) Release(deviceIPs []string) {
+	m.Lock()
+	defer m.Unlock()
+	m.released = append(m.released, deviceIPs)
+}
+
+func (m *stubManager) Reserved() ([]string, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.reserved, m.err
+}
+
+// newTestPlugin returns a plugin of the stub manager serving in the directory of the fake kubelet
+func newTestPlugin(k *fakeKubelet, m *stubManager) *CarizonDevicePlugin {
+	return newTestResourcePlugin(k, m, testResourceName)
+}
+
+func newTestResourcePlugin(k *fakeKubelet, m *stubManager, resourceName string) *CarizonDevicePlugin {
+	resource := conf.Resource{ResourceName: resourceName}
+	socket := k.socket(strings.NewReplacer("/", "_", ".", "_").Replace(resourceName) + ".sock")
+	return NewCarizonDevicePlugin(resourceName, m, testDeviceEnv, socket, resource)
+}
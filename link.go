@@ -0,0 +1,129 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"carizon-device-plugin/pkg/logger"
+)
+
+// takenGracePeriod protects devices just taken through a linked resource from
+// being dropped by a pod resources snapshot which is older than the allocation
+const takenGracePeriod = time.Minute
+
+// Link links the plugins of a parent resource and one of its sub resources.
+// Devices allocated through one of them become unavailable in the other.
+func (h *CarizonDevicePlugin) Link(other *CarizonDevicePlugin) {
+	h.Lock()
+	h.linked = append(h.linked, other)
+	h.Unlock()
+
+	other.Lock()
+	other.linked = append(other.linked, h)
+	other.Unlock()
+}
+
+// Unlink removes all the links of the plugin
+func (h *CarizonDevicePlugin) Unlink() {
+	h.Lock()
+	defer h.Unlock()
+	h.linked = nil
+}
+
+func (h *CarizonDevicePlugin) linkedPlugins() []*CarizonDevicePlugin {
+	h.RLock()
+	defer h.RUnlock()
+	return h.linked
+}
+
+// takeLinked marks the devices allocated by this plugin as taken in its linked plugins
+func (h *CarizonDevicePlugin) takeLinked(ids []string) {
+	for _, l := range h.linkedPlugins() {
+		l.addTaken(ids)
+	}
+}
+
+func (h *CarizonDevicePlugin) addTaken(ids []string) {
+	h.Lock()
+	changed := false
+	for _, id := range ids {
+		if _, ok := h.taken[id]; !ok {
+			changed = true
+		}
+		h.taken[id] = time.Now()
+	}
+	h.Unlock()
+
+	if changed {
+		log.Printf("'%s' devices taken by linked resource: %v", h.resourceName, ids)
+		h.notifyUpdate()
+	}
+}
+
+// syncTaken replaces the taken devices by the devices held through the linked
+// resources, keeping the devices taken within takenGracePeriod
+func (h *CarizonDevicePlugin) syncTaken(held map[string]bool) {
+	h.Lock()
+	changed := false
+	for id, at := range h.taken {
+		if !held[id] && time.Since(at) > takenGracePeriod {
+			delete(h.taken, id)
+			changed = true
+		}
+	}
+	for id := range held {
+		if _, ok := h.taken[id]; !ok {
+			h.taken[id] = time.Now()
+			changed = true
+		}
+	}
+	h.Unlock()
+
+	if changed {
+		h.notifyUpdate()
+	}
+}
+
+// syncLinkedDevices updates the taken devices of every plugin from the devices
+// the pods hold through its linked resources
+func syncLinkedDevices(plugins []*CarizonDevicePlugin, resourceInfos map[string]*ResourceInfo) {
+	for _, p := range plugins {
+		linked := p.linkedPlugins()
+		if len(linked) == 0 {
+			continue
+		}
+
+		held := make(map[string]bool)
+		for _, l := range linked {
+			if info, ok := resourceInfos[l.resourceName]; ok {
+				for _, id := range info.DeviceIDs {
+					held[id] = true
+				}
+			}
+		}
+		p.syncTaken(held)
+	}
+}
+
+// syncLinkedPodResources updates the taken devices of the linked plugins from
+// the pod resources of kubelet. It runs when plugins start and after the
+// resources are reconciled, the reservation cron only runs minutes later and
+// until then kubelet could allocate a device through both linked resources.
+func syncLinkedPodResources(plugins []*CarizonDevicePlugin) {
+	var linked []*CarizonDevicePlugin
+	for _, p := range plugins {
+		if len(p.linkedPlugins()) > 0 {
+			linked = append(linked, p)
+		}
+	}
+	if len(linked) == 0 {
+		return
+	}
+
+	pods, err := kubeletPodResources()
+	if err != nil {
+		logger.Wrapper.Errorf("[syncLinkedPodResources] Get pod resources error, taken devices not updated: %v", err)
+		return
+	}
+	syncLinkedDevices(linked, podResourceMap(pods))
+}
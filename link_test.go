@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"carizon-device-plugin/conf"
+)
+
+func TestLinkedResourcesExcludeEachOther(t *testing.T) {
+	k := newFakeKubelet(t)
+	parent := newTestResourcePlugin(k, newStubManager("10.0.0.1", "10.0.0.2"), testResourceName)
+	sub := newTestResourcePlugin(k, newStubManager("10.0.0.1", "10.0.0.2"), testResourceName+"-camera")
+	parent.Link(sub)
+
+	watch := func(p *CarizonDevicePlugin) (pluginapi.DevicePluginClient, <-chan []*pluginapi.Device) {
+		require.NoError(t, p.Start())
+		t.Cleanup(func() { p.Stop() })
+		client := k.connect(t, k.waitRegistered(t))
+		updates := k.watch(t, client)
+		require.Equal(t, map[string]string{"10.0.0.1": pluginapi.Healthy, "10.0.0.2": pluginapi.Healthy}, nextUpdate(t, updates))
+		return client, updates
+	}
+	parentClient, parentUpdates := watch(parent)
+	subClient, subUpdates := watch(sub)
+
+	// a device allocated through the parent can't be allocated through the sub resource
+	_, err := parentClient.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"10.0.0.1"}}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"10.0.0.1": pluginapi.Unhealthy, "10.0.0.2": pluginapi.Healthy}, nextUpdate(t, subUpdates))
+
+	// and the other way around
+	_, err = subClient.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"10.0.0.2"}}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"10.0.0.1": pluginapi.Healthy, "10.0.0.2": pluginapi.Unhealthy}, nextUpdate(t, parentUpdates))
+
+	// the pods still hold the devices, nothing changes
+	held := map[string]*ResourceInfo{
+		testResourceName:             {DeviceIDs: []string{"10.0.0.1"}},
+		testResourceName + "-camera": {DeviceIDs: []string{"10.0.0.2"}},
+	}
+	plugins := []*CarizonDevicePlugin{parent, sub}
+	syncLinkedDevices(plugins, held)
+	require.Contains(t, sub.taken, "10.0.0.1")
+	require.Contains(t, parent.taken, "10.0.0.2")
+
+	// devices taken within the grace period are kept even if the snapshot doesn't have them yet
+	syncLinkedDevices(plugins, map[string]*ResourceInfo{})
+	require.Contains(t, sub.taken, "10.0.0.1")
+
+	// once the pod of the parent is gone, the device is available again in the sub resource
+	sub.Lock()
+	sub.taken["10.0.0.1"] = time.Now().Add(-takenGracePeriod - time.Second)
+	sub.Unlock()
+	syncLinkedDevices(plugins, map[string]*ResourceInfo{testResourceName + "-camera": {DeviceIDs: []string{"10.0.0.2"}}})
+	require.Equal(t, map[string]string{"10.0.0.1": pluginapi.Healthy, "10.0.0.2": pluginapi.Healthy}, nextUpdate(t, subUpdates))
+	require.Contains(t, parent.taken, "10.0.0.2")
+}
+
+func TestLinkedDevicesTakenFromPodResources(t *testing.T) {
+	k := newFakeKubelet(t)
+	parent := newTestResourcePlugin(k, newStubManager("10.0.0.1", "10.0.0.2"), testResourceName)
+	sub := newTestResourcePlugin(k, newStubManager("10.0.0.1", "10.0.0.2"), testResourceName+"-camera")
+	parent.Link(sub)
+	k.setPodResources(newTestPod("pod-1", testResourceName, "10.0.0.1"))
+
+	watch := func(p *CarizonDevicePlugin) <-chan []*pluginapi.Device {
+		require.NoError(t, p.Start())
+		t.Cleanup(func() { p.Stop() })
+		return k.watch(t, k.connect(t, k.waitRegistered(t)))
+	}
+	parentUpdates := watch(parent)
+	require.Equal(t, map[string]string{"10.0.0.1": pluginapi.Healthy, "10.0.0.2": pluginapi.Healthy}, nextUpdate(t, parentUpdates))
+
+	// the device held through the parent is unavailable as soon as the sub resource starts
+	subUpdates := watch(sub)
+	require.Equal(t, map[string]string{"10.0.0.1": pluginapi.Unhealthy, "10.0.0.2": pluginapi.Healthy}, nextUpdate(t, subUpdates))
+
+	// e.g. after a reconcile, the devices held through the sub resource are taken in the parent
+	k.setPodResources(newTestPod("pod-1", testResourceName, "10.0.0.1"), newTestPod("pod-2", testResourceName+"-camera", "10.0.0.2"))
+	syncLinkedPodResources([]*CarizonDevicePlugin{parent, sub})
+	require.Equal(t, map[string]string{"10.0.0.1": pluginapi.Healthy, "10.0.0.2": pluginapi.Unhealthy}, nextUpdate(t, parentUpdates))
+}
+
+func TestReconciledSubResourceStartsWithTakenDevices(t *testing.T) {
+	k := newFakeKubelet(t)
+	s := newTestSupervisor(t)
+	parent := conf.Resource{ResourceName: "A", Backend: testBackend}
+	k.setPodResources(newTestPod("pod-1", resourceDomain+"A", "10.0.0.1"))
+
+	reconcilePlugins(s, getResourceSpecs([]conf.Resource{parent}, conf.Filter{}, nil))
+	r := k.waitRegistered(t)
+	require.Equal(t, map[string]string{"10.0.0.1": pluginapi.Healthy}, nextUpdate(t, k.watch(t, k.connect(t, r))))
+
+	// the new sub resource doesn't offer the device held through its parent
+	parent.SubResource = []conf.Resource{{ResourceName: "A-camera", Backend: testBackend}}
+	reconcilePlugins(s, getResourceSpecs([]conf.Resource{parent}, conf.Filter{}, nil))
+	r = k.waitRegistered(t)
+	require.Equal(t, resourceDomain+"A-camera", r.ResourceName)
+	require.Equal(t, map[string]string{"10.0.0.1": pluginapi.Unhealthy}, nextUpdate(t, k.watch(t, k.connect(t, r))))
+}
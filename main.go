@@ -3,7 +3,9 @@ package main
 import (
 	"carizon-device-plugin/conf"
 	httpclient "carizon-device-plugin/pkg/client"
+	"carizon-device-plugin/pkg/env"
 	"carizon-device-plugin/pkg/logger"
+	"carizon-device-plugin/pkg/metrics"
 	"carizon-device-plugin/pkg/nacos"
 	"math/rand"
 	"strings"
@@ -12,30 +14,15 @@ import (
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/robfig/cron"
-	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
 // HTTPClient init resty client
 var CmdbApiClient = httpclient.NewClient()
 
-func getAllPlugins() []*CarizonDevicePlugin {
-	plugins := []*CarizonDevicePlugin{}
-	for _, t := range conf.Conf.ResourceDevices {
-		// TODO: 对子资源也进行处理
-		plugin := NewCarizonDevicePlugin(
-			resourceDomain+t.ResourceName,
-			NewCarizonDeviceManager(t.ResourceName),
-			"CARIZON_DEVICE_"+t.ResourceName+"_IP_LIST",
-			pluginapi.DevicePluginPath+"carizon_"+t.ResourceName+".sock")
-		plugins = append(plugins, plugin)
-	}
-	return plugins
-}
-
-func startCron() {
+func startCron(supervisor *PluginSupervisor) {
 	c := cron.New()
 	if err := c.AddFunc("@every 3m", func() { // execute every 3 min
-		refreshDeviceReserved()
+		refreshDeviceReserved(supervisor.Plugins())
 	}); err != nil {
 		logger.Wrapper.Errorf("strat cron job error:%s", err.Error())
 	}
@@ -45,40 +32,177 @@ func startCron() {
 	c.Start()
 }
 
-func refreshDeviceReserved() {
-	var deviceList []string
+func refreshDeviceReserved(plugins []*CarizonDevicePlugin) {
+	var err error
+	defer func() {
+		metrics.ReconcileRuns.WithLabelValues(metrics.Result(err)).Inc()
+		if err == nil {
+			metrics.ReconcileLastSuccess.SetToCurrentTime()
+		}
+	}()
+
+	client, err := GetResourceClient("")
+	if err != nil {
+		logger.Wrapper.Errorf("[refreshDeviceReserved] get resource client error: %v", err)
+		return
+	}
+	pods, err := client.GetPodResources()
+	if err != nil {
+		logger.Wrapper.Errorf("[refreshDeviceReserved] get pod resources error: %v", err)
+		return
+	}
+	resourceInfos := podResourceMap(pods)
+
+	managers := resourceManagers(plugins)
+	reserveDevices(managers, resourceInfos)
+	pending := releaseDevices(managers, lastPodResources.pendingRelease(), previousPodResources(managers), resourceInfos)
+	lastPodResources.set(pods, resourceInfos, pending)
+	syncLinkedDevices(plugins, resourceInfos)
+	checkDeviceDrift(plugins, client)
+}
 
-	deviceManager := NewCarizonDeviceManager("")
-	client, _ := GetResourceClient("")
-	resourceInfos, _ := client.GetPodResourceMap()
+// resourceManagers returns the ResourceManager of every plugin keyed by resource name
+func resourceManagers(plugins []*CarizonDevicePlugin) map[string]ResourceManager {
+	managers := make(map[string]ResourceManager, len(plugins))
+	for _, p := range plugins {
+		managers[p.resourceName] = p.ResourceManager
+	}
+	return managers
+}
 
+// reserveDevices reserves the devices held by pods for their containers. Every
+// resource is reserved through the backend of its own plugin, resources of
+// other device plugins are skipped.
+func reserveDevices(managers map[string]ResourceManager, resourceInfos map[string]*ResourceInfo) {
 	for name, item := range resourceInfos {
-		//Composed chip type allocate directly,because device count is small
-		//will not make pressure to device manager microservice
-		if strings.Contains(name, "4J5") {
-			deviceManager.Allocate(item.DeviceIDs)
-		} else {
-			deviceList = append(deviceList, item.DeviceIDs...)
+		rm, ok := managers[name]
+		if !ok || len(item.DeviceIDs) == 0 {
+			continue
+		}
+
+		var owners []DeviceOwner
+		byOwner := make(map[DeviceOwner][]string)
+		for _, id := range item.DeviceIDs {
+			owner := item.Owners[id]
+			if _, ok := byOwner[owner]; !ok {
+				owners = append(owners, owner)
+			}
+			byOwner[owner] = append(byOwner[owner], id)
+		}
+		for _, owner := range owners {
+			rm.Allocate(byOwner[owner], Reservation{Node: NodeName, DeviceOwner: owner})
 		}
 	}
+}
 
-	if len(deviceList) == 0 {
-		return
+// previousPodResources returns the pod resources of the previous refresh. There is
+// none after a restart, the devices reserved by this node in the backends are used
+// instead so that the devices of the pods terminated in the meantime are released.
+func previousPodResources(managers map[string]ResourceManager) map[string]*ResourceInfo {
+	if previous := lastPodResources.get(); previous != nil {
+		return previous
+	}
+
+	previous := make(map[string]*ResourceInfo)
+	for name, rm := range managers {
+		if !strings.HasPrefix(name, resourceDomain) {
+			continue
+		}
+		ids, err := rm.Reserved()
+		if err != nil {
+			logger.Wrapper.Errorf("[previousPodResources] Get %s devices reserved by node %s error: %v", name, NodeName, err)
+			continue
+		}
+		if len(ids) > 0 {
+			previous[name] = &ResourceInfo{DeviceIDs: ids}
+		}
+	}
+	return previous
+}
+
+// releaseDevices releases the carizon devices of terminated pods. A device held
+// in the previous snapshot or pending release is only released once it is
+// missing from two consecutive snapshots, so that a single empty or partial
+// snapshot, e.g. right after a kubelet restart, doesn't release devices still in
+// use. It returns the devices missing for the first time, pending release.
+func releaseDevices(managers map[string]ResourceManager, pending map[string][]string, previous, current map[string]*ResourceInfo) map[string][]string {
+	candidates := make(map[string][]string)
+	for name, item := range previous {
+		candidates[name] = append(candidates[name], item.DeviceIDs...)
 	}
+	for name, ids := range pending {
+		candidates[name] = append(candidates[name], ids...)
+	}
+
+	next := make(map[string][]string)
+	for name, ids := range candidates {
+		if !strings.HasPrefix(name, resourceDomain) {
+			continue
+		}
+
+		held := make(map[string]bool)
+		if cur, ok := current[name]; ok {
+			for _, id := range cur.DeviceIDs {
+				held[id] = true
+			}
+		}
+		wasPending := make(map[string]bool)
+		for _, id := range pending[name] {
+			wasPending[id] = true
+		}
 
-	deviceManager.Allocate(deviceList)
+		var released []string
+		seen := make(map[string]bool)
+		for _, id := range ids {
+			if held[id] || seen[id] {
+				continue
+			}
+			seen[id] = true
+			if wasPending[id] {
+				released = append(released, id)
+			} else {
+				next[name] = append(next[name], id)
+			}
+		}
+		if len(released) == 0 {
+			continue
+		}
+
+		rm, ok := managers[name]
+		if !ok {
+			logger.Wrapper.Errorf("[releaseDevices] No plugin serves %s, devices %v are not released", name, released)
+			continue
+		}
+		rm.Release(released)
+	}
+	return next
+}
 
+// handleFSEvent restarts all the plugins when kubelet restarted, and re-registers
+// the plugin whose socket was removed
+func handleFSEvent(supervisor *PluginSupervisor, event fsnotify.Event) {
+	if event.Name == kubeletSocket && event.Op&fsnotify.Create == fsnotify.Create {
+		logger.Wrapper.Infof("[main][event] inotify: %s created, restarting.", kubeletSocket)
+		supervisor.RestartAll()
+	} else if event.Op&fsnotify.Remove == fsnotify.Remove {
+		supervisor.SocketRemoved(event.Name)
+	}
 }
 
 func main() {
-	nacos.Init("model", "DEFAULT_GROUP", "carizon.cmdb", "config", &conf.Conf)
+	env.Init()
+	var loaded conf.Config
+	nacos.Init("model", "DEFAULT_GROUP", "carizon.cmdb", "config", &loaded)
+	conf.Set(loaded)
 
 	if CmdbApiClient == nil {
 		logger.Wrapper.Fatalln("[main] Failed to init CmdbApiClient")
 	}
 	// TODO: verify Carizon device-manager accessible
+	initKubeClient()
+
 	logger.Wrapper.Infoln("[main] Starting FS watcher.")
-	watcher, err := newFSWatcher(pluginapi.DevicePluginPath)
+	watcher, err := newFSWatcher(devicePluginPath)
 	if err != nil {
 		logger.Wrapper.Fatalln("[main] Create FS watcher failed.")
 	}
@@ -87,52 +211,58 @@ func main() {
 	logger.Wrapper.Infoln("[main] Starting OS watcher.")
 	sigs := newOSWatcher(syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
+	logger.Wrapper.Infoln("[main] Watching config changes.")
+	configChanged := make(chan struct{}, 1)
+	nacos.OnConfigChange(func(changed interface{}) {
+		conf.Set(*changed.(*conf.Config))
+		select {
+		case configChanged <- struct{}{}:
+		default:
+		}
+	})
+
 	logger.Wrapper.Infoln("[main] Retrieving plugins.")
+	supervisor := NewPluginSupervisor()
 	plugins := getAllPlugins()
-
-	go startCron()
-
-restart:
-	pluginStartError := make(chan struct{})
-	started := 0
 	for _, plugin := range plugins {
-		plugin.Stop()
-
-		if err := plugin.Start(); err != nil {
-			logger.Wrapper.Infoln("[main] Start plugin error: %s", err.Error())
-			close(pluginStartError)
-			goto events
-		}
-		started++
+		supervisor.Add(plugin)
 	}
-
-	if started == 0 {
+	if len(plugins) == 0 {
 		logger.Wrapper.Infoln("[main] No device found. Waiting indefinitely.")
 	}
 
-events:
+	go startCron(supervisor)
+	startHTTPServer(supervisor)
+
+	stop := make(chan struct{})
+	go supervisor.Watch(stop, registrationCheckInterval)
+	features := &nodeFeaturesPublisher{supervisor: supervisor}
+	features.Update(conf.Get().NodeFeatures)
+
 	for {
 		select {
-		case <-pluginStartError:
-			goto restart
+		case <-configChanged:
+			logger.Wrapper.Infoln("[main][event] Config changed, reconciling plugins.")
+			config := conf.Get()
+			reconcilePlugins(supervisor, getResourceSpecs(config.ResourceDevices, conf.Filter{}, nil))
+			// the links of the plugins which kept serving may have changed
+			syncLinkedPodResources(supervisor.Plugins())
+			features.Update(config.NodeFeatures)
 		case event := <-watcher.Events:
-			if event.Name == pluginapi.KubeletSocket && event.Op&fsnotify.Create == fsnotify.Create {
-				logger.Wrapper.Infoln("[main][event] inotify: %s created, restarting.", pluginapi.KubeletSocket)
-				goto restart
-			}
+			handleFSEvent(supervisor, event)
 		case err := <-watcher.Errors:
-			logger.Wrapper.Infoln("[main][event] inotify: %s", err)
+			logger.Wrapper.Infof("[main][event] inotify: %s", err)
 		case s := <-sigs:
 			switch s {
 			case syscall.SIGHUP:
 				logger.Wrapper.Infoln("[main][event] Received SIGHUP, restarting.")
-				goto restart
+				supervisor.RestartAll()
 			default:
 				logger.Wrapper.Infof("[main][event] Received signal \"%v\", shutting down.", s)
-				for _, p := range plugins {
-					p.Stop()
-				}
-				break events
+				close(stop)
+				features.Stop()
+				supervisor.StopAll()
+				return
 			}
 		}
 	}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"carizon-device-plugin/pkg/env"
+)
+
+// testAppName is the service name of the tests when APP_NAME is unset
+const testAppName = "carizon-device-plugin-test"
+
+// TestMain loads the service environment as main does
+func TestMain(m *testing.M) {
+	if os.Getenv(env.AppName) == "" {
+		os.Setenv(env.AppName, testAppName)
+	}
+	env.Init()
+	os.Exit(m.Run())
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+
+	"carizon-device-plugin/pkg/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+var (
+	devicesDesc = prometheus.NewDesc(metrics.Namespace+"_devices",
+		"Number of devices reported to kubelet by resource and health.",
+		[]string{"resource", "health"}, nil)
+	pluginStateDesc = prometheus.NewDesc(metrics.Namespace+"_plugin_state",
+		"State of the resource plugins, 1 for the current state.",
+		[]string{"resource", "state"}, nil)
+
+	pluginStates = []PluginState{PluginStarting, PluginRunning, PluginBackOff, PluginStopped}
+)
+
+// pluginCollector collects the device counts and states of the supervised
+// plugins at scrape time
+type pluginCollector struct {
+	supervisor *PluginSupervisor
+}
+
+// Describe implements prometheus.Collector
+func (c pluginCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- devicesDesc
+	ch <- pluginStateDesc
+}
+
+// Collect implements prometheus.Collector
+func (c pluginCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, p := range c.supervisor.Plugins() {
+		counts := map[string]int{pluginapi.Healthy: 0, pluginapi.Unhealthy: 0}
+		for _, d := range p.apiDevices() {
+			counts[d.Health]++
+		}
+		for health, n := range counts {
+			ch <- prometheus.MustNewConstMetric(devicesDesc, prometheus.GaugeValue, float64(n), p.resourceName, strings.ToLower(health))
+		}
+	}
+
+	for _, status := range c.supervisor.Status() {
+		for _, state := range pluginStates {
+			value := 0.0
+			if status.State == state {
+				value = 1
+			}
+			ch <- prometheus.MustNewConstMetric(pluginStateDesc, prometheus.GaugeValue, value, status.ResourceName, string(state))
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPluginCollector(t *testing.T) {
+	k := newFakeKubelet(t)
+	m := newStubManager("10.0.0.1", "10.0.0.2")
+	failing := newStubManager("10.0.0.3")
+	failing.setError(errors.New("cmdb unavailable"))
+	s := newTestSupervisor(t, newTestPlugin(k, m), newTestResourcePlugin(k, failing, "carizon.io/failing"))
+
+	updates := k.watch(t, k.connect(t, k.waitRegistered(t)))
+	nextUpdate(t, updates)
+	m.flip(t, "10.0.0.2", false)
+	nextUpdate(t, updates)
+	require.Eventually(t, func() bool {
+		return s.Status()[1].State == PluginBackOff
+	}, testTimeout, 10*time.Millisecond)
+
+	require.NoError(t, testutil.CollectAndCompare(pluginCollector{supervisor: s}, strings.NewReader(`
+# HELP carizon_device_plugin_devices Number of devices reported to kubelet by resource and health.
+# TYPE carizon_device_plugin_devices gauge
+carizon_device_plugin_devices{health="healthy",resource="carizon.io/failing"} 0
+carizon_device_plugin_devices{health="healthy",resource="carizon.io/test"} 1
+carizon_device_plugin_devices{health="unhealthy",resource="carizon.io/failing"} 0
+carizon_device_plugin_devices{health="unhealthy",resource="carizon.io/test"} 1
+# HELP carizon_device_plugin_plugin_state State of the resource plugins, 1 for the current state.
+# TYPE carizon_device_plugin_plugin_state gauge
+carizon_device_plugin_plugin_state{resource="carizon.io/failing",state="BackOff"} 1
+carizon_device_plugin_plugin_state{resource="carizon.io/failing",state="Running"} 0
+carizon_device_plugin_plugin_state{resource="carizon.io/failing",state="Starting"} 0
+carizon_device_plugin_plugin_state{resource="carizon.io/failing",state="Stopped"} 0
+carizon_device_plugin_plugin_state{resource="carizon.io/test",state="BackOff"} 0
+carizon_device_plugin_plugin_state{resource="carizon.io/test",state="Running"} 1
+carizon_device_plugin_plugin_state{resource="carizon.io/test",state="Starting"} 0
+carizon_device_plugin_plugin_state{resource="carizon.io/test",state="Stopped"} 0
+`)))
+}
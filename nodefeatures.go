@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"carizon-device-plugin/conf"
+	"carizon-device-plugin/pkg/logger"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	nodeFeaturePrefix         = "carizon.io/"
+	nodeInventoryAnnotation   = nodeFeaturePrefix + "device-inventory"
+	defaultNodeFeaturesResync = 10 * time.Minute
+	maxNodeLabelNameLength    = 63
+)
+
+// feature label kinds, a label is nodeFeaturePrefix + kind + value
+const (
+	nodeLabelChipType      = "chip-type."
+	nodeLabelSystemVersion = "system-version."
+	nodeLabelLocation      = "location."
+	nodeLabelTag           = "tag."
+)
+
+var invalidLabelChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// devicesChanged is signaled when the devices of a plugin changed
+var devicesChanged = make(chan struct{}, 1)
+
+// notifyNodeFeatures asks the node feature publisher to publish again
+func notifyNodeFeatures() {
+	select {
+	case devicesChanged <- struct{}{}:
+	default:
+	}
+}
+
+// inventoryDevice is a device in the inventory annotation of the node
+type inventoryDevice struct {
+	IP            string `json:"ip"`
+	UUID          int    `json:"uuid"`
+	ChipType      string `json:"chip_type,omitempty"`
+	SystemVersion string `json:"system_version,omitempty"`
+	Location      string `json:"location,omitempty"`
+	Tags          string `json:"tags,omitempty"`
+}
+
+// publishNodeFeatures publishes the devices of the plugins as node labels and
+// an inventory annotation whenever the devices change, until stop is closed
+func publishNodeFeatures(stop <-chan struct{}, supervisor *PluginSupervisor, cfg conf.NodeFeatures) {
+	if kubeClient == nil {
+		logger.Wrapper.Errorf("[node-features] No kubernetes client, node features are not published")
+		return
+	}
+	resync := cfg.ResyncInterval
+	if resync <= 0 {
+		resync = defaultNodeFeaturesResync
+	}
+
+	var (
+		lastLabels    map[string]string
+		lastInventory string
+	)
+	for {
+		// wait for the plugins to discover their devices before publishing
+		select {
+		case <-stop:
+			return
+		case <-devicesChanged:
+		case <-time.After(resync):
+			// republish in case the node was changed by someone else
+			lastLabels, lastInventory = nil, ""
+		}
+
+		labels, inventory := nodeFeatures(supervisor.Plugins())
+		if reflect.DeepEqual(labels, lastLabels) && inventory == lastInventory {
+			continue
+		}
+		if err := patchNodeFeatures(labels, inventory); err != nil {
+			logger.Wrapper.Errorf("[node-features] Patch node %s error: %v", NodeName, err)
+			continue
+		}
+		logger.Wrapper.Infof("[node-features] Published %d labels on node %s", len(labels), NodeName)
+		lastLabels, lastInventory = labels, inventory
+	}
+}
+
+// nodeFeaturesPublisher runs publishNodeFeatures while node features are
+// enabled. It is only used by the main loop.
+type nodeFeaturesPublisher struct {
+	supervisor *PluginSupervisor
+	cfg        conf.NodeFeatures
+	// updated is set after the first Update
+	updated bool
+	// stop and done of the running publishNodeFeatures, nil when not running
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Update starts, restarts or stops publishing for the node features config.
+// Disabling node features removes them from the node.
+func (p *nodeFeaturesPublisher) Update(cfg conf.NodeFeatures) {
+	running := p.stop != nil
+	if running && cfg == p.cfg {
+		return
+	}
+	p.Stop()
+	p.cfg = cfg
+	defer func() { p.updated = true }()
+	if !cfg.Enabled {
+		if running {
+			clearNodeFeatures()
+		}
+		return
+	}
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	p.stop, p.done = stop, done
+	go func() {
+		defer close(done)
+		publishNodeFeatures(stop, p.supervisor, cfg)
+	}()
+	// at startup the plugins signal once they discovered their devices, later
+	// they already did
+	if p.updated {
+		notifyNodeFeatures()
+	}
+}
+
+// Stop stops publishing and waits for the publisher to return
+func (p *nodeFeaturesPublisher) Stop() {
+	if p.stop == nil {
+		return
+	}
+	close(p.stop)
+	<-p.done
+	p.stop, p.done = nil, nil
+}
+
+// nodeFeatures returns the feature labels and the inventory annotation of the devices
+func nodeFeatures(plugins []*CarizonDevicePlugin) (map[string]string, string) {
+	labels := make(map[string]string)
+	inventory := make(map[string][]inventoryDevice)
+	for _, p := range plugins {
+		devices := []inventoryDevice{}
+		for _, d := range p.devices() {
+			addFeatureLabel(labels, nodeLabelChipType, d.ChipType)
+			addFeatureLabel(labels, nodeLabelSystemVersion, d.SystemVersion)
+			addFeatureLabel(labels, nodeLabelLocation, d.Location)
+			for _, t := range strings.Split(d.Tags, ",") {
+				addFeatureLabel(labels, nodeLabelTag, strings.TrimSpace(t))
+			}
+			devices = append(devices, inventoryDevice{
+				IP:            d.IP,
+				UUID:          d.UUID,
+				ChipType:      d.ChipType,
+				SystemVersion: d.SystemVersion,
+				Location:      d.Location,
+				Tags:          d.Tags,
+			})
+		}
+		sort.Slice(devices, func(i, j int) bool { return devices[i].IP < devices[j].IP })
+		inventory[p.resourceName] = devices
+	}
+
+	// map keys are sorted by encoding/json, so the annotation is stable
+	data, err := json.Marshal(inventory)
+	if err != nil {
+		logger.Wrapper.Errorf("[node-features] Marshal inventory error: %v", err)
+	}
+	return labels, string(data)
+}
+
+// addFeatureLabel adds the label kind+value, characters not allowed in a label
+// name are replaced and values too long for a label name are skipped
+func addFeatureLabel(labels map[string]string, kind, value string) {
+	value = strings.Trim(invalidLabelChars.ReplaceAllString(value, "-"), "-_.")
+	if value == "" || len(kind)+len(value) > maxNodeLabelNameLength {
+		return
+	}
+	labels[nodeFeaturePrefix+kind+value] = "true"
+}
+
+// patchNodeFeatures sets the feature labels and the inventory annotation of the
+// node, and removes the feature labels of devices which are gone. An empty
+// inventory removes the annotation.
+func patchNodeFeatures(labels map[string]string, inventory string) error {
+	node, err := kubeClient.CoreV1().Nodes().Get(context.TODO(), NodeName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	patch, err := nodeFeaturesPatch(node.Labels, labels, inventory)
+	if err != nil {
+		return err
+	}
+	_, err = kubeClient.CoreV1().Nodes().Patch(context.TODO(), NodeName, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// nodeFeaturesPatch returns the strategic merge patch of a node with the
+// labels nodeLabels, feature labels of nodeLabels not in labels are removed
+func nodeFeaturesPatch(nodeLabels, labels map[string]string, inventory string) ([]byte, error) {
+	patchLabels := make(map[string]interface{}, len(labels))
+	for k, v := range labels {
+		patchLabels[k] = v
+	}
+	for k := range nodeLabels {
+		if _, ok := labels[k]; !ok && isFeatureLabel(k) {
+			patchLabels[k] = nil
+		}
+	}
+
+	var annotation interface{}
+	if inventory != "" {
+		annotation = inventory
+	}
+	return json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels":      patchLabels,
+			"annotations": map[string]interface{}{nodeInventoryAnnotation: annotation},
+		},
+	})
+}
+
+// clearNodeFeatures removes the feature labels and the inventory annotation of the node
+func clearNodeFeatures() {
+	if kubeClient == nil {
+		return
+	}
+	if err := patchNodeFeatures(nil, ""); err != nil {
+		logger.Wrapper.Errorf("[node-features] Clear node %s error: %v", NodeName, err)
+		return
+	}
+	logger.Wrapper.Infof("[node-features] Cleared the features of node %s", NodeName)
+}
+
+func isFeatureLabel(key string) bool {
+	for _, kind := range []string{nodeLabelChipType, nodeLabelSystemVersion, nodeLabelLocation, nodeLabelTag} {
+		if strings.HasPrefix(key, nodeFeaturePrefix+kind) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"carizon-device-plugin/conf"
+)
+
+// newFakeNode points kubeClient at a fake clientset holding the node of the plugin
+func newFakeNode(t *testing.T, labels map[string]string) {
+	prevClient, prevNode := kubeClient, NodeName
+	NodeName = "node-1"
+	kubeClient = fake.NewSimpleClientset(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: NodeName, Labels: labels}})
+	t.Cleanup(func() { kubeClient, NodeName = prevClient, prevNode })
+}
+
+func getFakeNode(t *testing.T) *v1.Node {
+	node, err := kubeClient.CoreV1().Nodes().Get(context.TODO(), NodeName, metav1.GetOptions{})
+	require.NoError(t, err)
+	return node
+}
+
+func TestNodeFeatures(t *testing.T) {
+	j5 := &CarizonDevicePlugin{resourceName: resourceDomain + "J5", cachedDevices: []*Device{
+		buildDevice(&externalDevice{UUID: 2, IP: "10.0.0.2", ChipType: "J5", SystemVersion: "1.2.0", Location: "rack 1", Tags: "camera, lab"}),
+		buildDevice(&externalDevice{UUID: 1, IP: "10.0.0.1", ChipType: "J5", SystemVersion: "1.3.0", Location: "rack 1", Tags: "lab"}),
+	}}
+	x3 := &CarizonDevicePlugin{resourceName: resourceDomain + "X3"}
+
+	labels, inventory := nodeFeatures([]*CarizonDevicePlugin{j5, x3})
+	require.Equal(t, map[string]string{
+		"carizon.io/chip-type.J5":         "true",
+		"carizon.io/system-version.1.2.0": "true",
+		"carizon.io/system-version.1.3.0": "true",
+		"carizon.io/location.rack-1":      "true",
+		"carizon.io/tag.camera":           "true",
+		"carizon.io/tag.lab":              "true",
+	}, labels)
+	require.JSONEq(t, `{
+		"carizon/J5": [
+			{"ip": "10.0.0.1", "uuid": 1, "chip_type": "J5", "system_version": "1.3.0", "location": "rack 1", "tags": "lab"},
+			{"ip": "10.0.0.2", "uuid": 2, "chip_type": "J5", "system_version": "1.2.0", "location": "rack 1", "tags": "camera, lab"}
+		],
+		"carizon/X3": []
+	}`, inventory)
+}
+
+func TestNodeFeaturesPatch(t *testing.T) {
+	nodeLabels := map[string]string{
+		"kubernetes.io/hostname":  "node-1",
+		"carizon.io/chip-type.J5": "true",
+		"carizon.io/tag.old":      "true",
+	}
+
+	patch, err := nodeFeaturesPatch(nodeLabels, map[string]string{"carizon.io/chip-type.J5": "true", "carizon.io/tag.lab": "true"}, `{"carizon/J5":[]}`)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"metadata": {
+		"labels": {"carizon.io/chip-type.J5": "true", "carizon.io/tag.lab": "true", "carizon.io/tag.old": null},
+		"annotations": {"carizon.io/device-inventory": "{\"carizon/J5\":[]}"}
+	}}`, string(patch))
+
+	// no inventory clears the features
+	patch, err = nodeFeaturesPatch(nodeLabels, nil, "")
+	require.NoError(t, err)
+	require.JSONEq(t, `{"metadata": {
+		"labels": {"carizon.io/chip-type.J5": null, "carizon.io/tag.old": null},
+		"annotations": {"carizon.io/device-inventory": null}
+	}}`, string(patch))
+}
+
+func TestPatchNodeFeatures(t *testing.T) {
+	newFakeNode(t, map[string]string{"kubernetes.io/hostname": "node-1", "carizon.io/tag.old": "true"})
+
+	require.NoError(t, patchNodeFeatures(map[string]string{"carizon.io/chip-type.J5": "true"}, `{"carizon/J5":[]}`))
+	node := getFakeNode(t)
+	require.Equal(t, map[string]string{"kubernetes.io/hostname": "node-1", "carizon.io/chip-type.J5": "true"}, node.Labels)
+	require.Equal(t, `{"carizon/J5":[]}`, node.Annotations[nodeInventoryAnnotation])
+
+	clearNodeFeatures()
+	node = getFakeNode(t)
+	require.Equal(t, map[string]string{"kubernetes.io/hostname": "node-1"}, node.Labels)
+	require.NotContains(t, node.Annotations, nodeInventoryAnnotation)
+}
+
+func TestNodeFeaturesPublisher(t *testing.T) {
+	newFakeNode(t, nil)
+	k := newFakeKubelet(t)
+	s := newTestSupervisor(t, newTestPlugin(k, newStubManager("10.0.0.1")))
+	nextUpdate(t, k.watch(t, k.connect(t, k.waitRegistered(t))))
+
+	inventory := func() map[string][]inventoryDevice {
+		value, ok := getFakeNode(t).Annotations[nodeInventoryAnnotation]
+		if !ok {
+			return nil
+		}
+		var devices map[string][]inventoryDevice
+		require.NoError(t, json.Unmarshal([]byte(value), &devices))
+		return devices
+	}
+	published := func() bool { return len(inventory()[testResourceName]) == 1 }
+
+	p := &nodeFeaturesPublisher{supervisor: s}
+	defer p.Stop()
+
+	p.Update(conf.NodeFeatures{})
+	p.Update(conf.NodeFeatures{Enabled: true})
+	require.Eventually(t, published, 5*time.Second, 10*time.Millisecond)
+
+	// disabling removes the features from the node
+	p.Update(conf.NodeFeatures{})
+	require.Nil(t, inventory())
+
+	// enabling again publishes without waiting for a device change
+	p.Update(conf.NodeFeatures{Enabled: true, ResyncInterval: time.Hour})
+	require.Eventually(t, published, 5*time.Second, 10*time.Millisecond)
+}
@@ -5,8 +5,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
+	ccErr "carizon-device-plugin/pkg/errors"
 	"carizon-device-plugin/pkg/logger"
 
 	"github.com/go-resty/resty/v2"
@@ -40,6 +42,8 @@ type client struct {
 	cli    *resty.Client
 }
 
+// Result 请求的结果，Do*方法总是返回非nil的Result。
+// 请求失败或者http状态码不是2xx时Err不为nil
 type Result struct {
 	Body       []byte
 	Err        error
@@ -70,10 +74,10 @@ func NewClient() IClient {
 }
 
 type IClient interface {
-	DoGet(ctx context.Context, url string, header, query map[string]string) (data []byte, err error)
+	DoGet(ctx context.Context, url string, header, query map[string]string) (r *Result)
 	DoPost(ctx context.Context, url string, header map[string]string, body interface{}) (r *Result)
 	DoPut(ctx context.Context, url string, header map[string]string, body interface{}) (r *Result)
-	DoDelete(ctx context.Context, url string, header map[string]string, timeout int) (data []byte, err error)
+	DoDelete(ctx context.Context, url string, header map[string]string) (r *Result)
 	GetCli() *resty.Client
 }
 
@@ -81,28 +85,9 @@ func (c *client) GetCli() *resty.Client {
 	return c.cli
 }
 
-// DoGet get方法 timeout单位：s
-func (c *client) DoGet(ctx context.Context, url string, header, query map[string]string) (body []byte, err error) {
-	req := c.cli.R().SetContext(ctx).SetHeaders(header).SetQueryParams(query)
-	resp, err := req.Get(url)
-	if err != nil {
-		return
-	}
-	duration := resp.Time()
-
-	logger.Wrapper.Infof("retry times:%d", resp.Request.TraceInfo().RequestAttempt)
-
-	body = resp.Body()
-
-	logger.Wrapper.Debugf("[HTTP][Get] url:%s status:%d query:%s cost: %fs",
-		url, resp.StatusCode(), req.RawRequest.URL.RawQuery, duration.Seconds())
-
-	if resp.StatusCode() != http.StatusOK {
-		err = newHttpError(url, int32(resp.StatusCode()))
-		return
-	}
-
-	return
+// DoGet get方法
+func (c *client) DoGet(ctx context.Context, url string, header, query map[string]string) (result *Result) {
+	return c.do(ctx, http.MethodGet, url, header, query, nil)
 }
 
 // DoPost Post方法，只支持json格式
@@ -110,39 +95,8 @@ func (c *client) DoGet(ctx context.Context, url string, header, query map[string
 //
 //	json: []byte
 //	form: map[string]string
-//
-// timeout单位：s
 func (c *client) DoPost(ctx context.Context, url string, header map[string]string, body interface{}) (result *Result) {
-	// 默认json格式
-	if header[HeaderContentType] == "" {
-		header[HeaderContentType] = ContentTypeJson
-	}
-
-	req := c.cli.R().SetContext(ctx).SetHeaders(header).SetBody(body)
-
-	if len(req.Header) == 0 {
-		req.Header = make(http.Header)
-	}
-
-	// 删除 Accept-Encoding 避免返回值被压缩
-	req.Header.Del("Accept-Encoding")
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Accept", "application/json")
-	resp, err := req.Post(url)
-	if err != nil {
-		result.Err = err
-		return
-	}
-
-	logger.Wrapper.Debugf("[CmdbApiClient] cost: %dms,%s %s with body %s, response status: %s, "+
-		"response body: %s", resp.Time().Seconds(),
-		resp.Request.Method, url, body, resp.Status, resp.Body())
-
-	result.Body = resp.Body()
-	result.StatusCode = resp.StatusCode()
-	result.Status = resp.Status()
-	result.Header = resp.Header()
-	return result
+	return c.do(ctx, http.MethodPost, url, header, nil, body)
 }
 
 // DoPut Put方法，只支持json格式
@@ -150,73 +104,60 @@ func (c *client) DoPost(ctx context.Context, url string, header map[string]strin
 //
 //	json: []byte
 //	form: map[string]string
-//
-// timeout单位：s
 func (c *client) DoPut(ctx context.Context, url string, header map[string]string, body interface{}) (result *Result) {
-	// 默认json格式
-	if header[HeaderContentType] == "" {
-		header[HeaderContentType] = ContentTypeJson
-	}
+	return c.do(ctx, http.MethodPut, url, header, nil, body)
+}
 
-	req := c.cli.R().SetContext(ctx).SetHeaders(header).SetBody(body)
+// DoDelete delete方法
+func (c *client) DoDelete(ctx context.Context, url string, header map[string]string) (result *Result) {
+	return c.do(ctx, http.MethodDelete, url, header, nil, nil)
+}
 
-	if len(req.Header) == 0 {
-		req.Header = make(http.Header)
+// do 发送请求，body不为nil时默认使用json格式
+func (c *client) do(ctx context.Context, method, url string, header, query map[string]string, body interface{}) *Result {
+	req := c.cli.R().SetContext(ctx).SetHeaders(header).SetQueryParams(query)
+	if body != nil {
+		req.SetBody(body)
+		// 默认json格式
+		if header[HeaderContentType] == "" {
+			req.Header.Set(HeaderContentType, ContentTypeJson)
+		}
+		// 删除 Accept-Encoding 避免返回值被压缩
+		req.Header.Del("Accept-Encoding")
+		req.Header.Set("Accept", ContentTypeJson)
 	}
 
-	// 删除 Accept-Encoding 避免返回值被压缩
-	req.Header.Del("Accept-Encoding")
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Accept", "application/json")
-	resp, err := req.Put(url)
+	start := time.Now()
+	resp, err := req.Execute(method, url)
+	observe(method, url, start, resp, err)
+	result := &Result{Err: err}
 	if err != nil {
-		result.Err = err
-		return
+		return result
 	}
 
-	logger.Wrapper.Debugf("[CmdbApiClient] cost: %dms,%s %s with body %s, response status: %s, "+
-		"response body: %s", resp.Time().Seconds(),
-		resp.Request.Method, url, body, resp.Status, resp.Body())
+	logger.Wrapper.Debugf("[HTTP][%s] url:%s status:%s attempts:%d cost: %fs body:%s response body:%s",
+		method, url, resp.Status(), resp.Request.TraceInfo().RequestAttempt, resp.Time().Seconds(), body, resp.Body())
 
 	result.Body = resp.Body()
 	result.StatusCode = resp.StatusCode()
 	result.Status = resp.Status()
 	result.Header = resp.Header()
-	return result
-}
-
-// DoDelete delete方法 timeout单位：s
-func (c *client) DoDelete(ctx context.Context, url string, header map[string]string, timeout int) (body []byte, err error) {
-
-	start := time.Now()
-	// https://github.com/go-resty/resty#retries
-	req := c.cli.R().SetContext(ctx).EnableTrace().SetHeaders(header)
-	resp, err := req.Delete(url)
-	if err != nil {
-		return
-	}
-	duration := time.Since(start)
-
-	body = resp.Body()
-	logger.Wrapper.Debugf("[HTTP][Delete] url:%s status:%d query:%s cost: %fs",
-		url, resp.StatusCode(), req.RawRequest.URL.RawQuery, duration.Seconds())
-
-	if resp.StatusCode() != http.StatusOK {
-		err = newHttpError(url, int32(resp.StatusCode()))
-		return
+	if resp.StatusCode() < http.StatusOK || resp.StatusCode() >= http.StatusMultipleChoices {
+		result.Err = newHttpError(method, url, int32(resp.StatusCode()))
 	}
-
-	return
+	return result
 }
 
+// HttpError 请求返回的http状态码不是2xx
 type HttpError struct {
+	method string
 	url    string
 	status int32
 }
 
 // Error 返回error信息
 func (he HttpError) Error() string {
-	return fmt.Sprintf("[http][get] url: %s status_code: %d", he.url, he.status)
+	return fmt.Sprintf("[http][%s] url: %s status_code: %d", strings.ToLower(he.method), he.url, he.status)
 }
 
 // StatusCode 返回 http code
@@ -225,27 +166,48 @@ func (he HttpError) StatusCode() int32 {
 }
 
 // newHttpError 创建error
-func newHttpError(url string, status int32) HttpError {
-	return HttpError{url: url, status: status}
+func newHttpError(method, url string, status int32) HttpError {
+	return HttpError{method: method, url: url, status: status}
 }
 
-// Into TODO
+// envelope CMDB接口返回的公共字段
+type envelope struct {
+	Result *bool  `json:"result"`
+	Code   int    `json:"bk_error_code"`
+	ErrMsg string `json:"bk_error_msg"`
+}
+
+// CCError 返回CMDB返回的业务错误，body不是CMDB的返回格式或者result为true时返回nil
+func (r *Result) CCError() ccErr.CCErrorCoder {
+	var env envelope
+	if err := json.Unmarshal(r.Body, &env); err != nil || env.Result == nil || *env.Result {
+		return nil
+	}
+	return ccErr.New(env.Code, env.ErrMsg)
+}
+
+// Into 将body解析到obj中。请求失败时返回请求的错误，
+// CMDB返回result为false时返回带有CMDB错误码和错误信息的ccErr.CCErrorCoder
 func (r *Result) Into(obj interface{}) error {
-	if nil != r.Err {
+	if r.Err != nil {
 		return r.Err
 	}
+	if len(r.Body) == 0 {
+		return nil
+	}
+	if err := r.CCError(); err != nil {
+		return err
+	}
 
-	if 0 != len(r.Body) {
-		err := json.Unmarshal(r.Body, obj)
-		if err != nil {
-			if r.StatusCode >= 300 {
-				return fmt.Errorf("http request err: %s", string(r.Body))
-			}
-			logger.Wrapper.Errorf("invalid response body, unmarshal json failed, reply:%s, error:%s", r.Body, err.Error())
-			return fmt.Errorf("http response err: %v, raw data: %s", err, r.Body)
-		}
-	} else if r.StatusCode >= 300 {
-		return fmt.Errorf("http request failed: %s", r.Status)
+	if err := json.Unmarshal(r.Body, obj); err != nil {
+		logger.Wrapper.Errorf("invalid response body, unmarshal json failed, reply:%s, error:%s", r.Body, err.Error())
+		return fmt.Errorf("http response err: %v, raw data: %s", err, r.Body)
 	}
 	return nil
 }
+
+// IsCCError 判断err是否为CMDB返回的业务错误，否则为请求本身或者解析body的错误
+func IsCCError(err error) bool {
+	_, ok := err.(ccErr.CCErrorCoder)
+	return ok
+}
@@ -0,0 +1,112 @@
+package httpclient_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	httpclient "carizon-device-plugin/pkg/client"
+	ccErr "carizon-device-plugin/pkg/errors"
+)
+
+type reply struct {
+	Result bool   `json:"result"`
+	Code   int    `json:"bk_error_code"`
+	ErrMsg string `json:"bk_error_msg"`
+	Data   string `json:"data"`
+}
+
+func newClient() httpclient.IClient {
+	c := httpclient.NewClient()
+	c.GetCli().SetRetryCount(0)
+	return c
+}
+
+func newServer(t *testing.T, status int, body interface{}) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(body)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestDoReturnsResult(t *testing.T) {
+	var method, body string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		method, body = r.Method, string(data)
+		json.NewEncoder(w).Encode(reply{Result: true, Data: "ok"})
+	}))
+	defer s.Close()
+
+	c := newClient()
+	for _, r := range []*httpclient.Result{
+		c.DoGet(context.Background(), s.URL, httpclient.EmptyHeader, httpclient.EmptyQuery),
+		c.DoPost(context.Background(), s.URL, httpclient.EmptyHeader, map[string]string{"ip": "10.0.0.1"}),
+		c.DoPut(context.Background(), s.URL, httpclient.EmptyHeader, map[string]string{"ip": "10.0.0.1"}),
+		c.DoDelete(context.Background(), s.URL, httpclient.EmptyHeader),
+	} {
+		require.NotNil(t, r)
+		require.NoError(t, r.Err)
+		require.Equal(t, http.StatusOK, r.StatusCode)
+
+		resp := new(reply)
+		require.NoError(t, r.Into(resp))
+		require.Equal(t, "ok", resp.Data)
+	}
+	require.Equal(t, http.MethodDelete, method)
+	require.Empty(t, httpclient.EmptyHeader)
+
+	c.DoPut(context.Background(), s.URL, httpclient.EmptyHeader, map[string]string{"ip": "10.0.0.1"})
+	require.Equal(t, http.MethodPut, method)
+	require.JSONEq(t, `{"ip":"10.0.0.1"}`, body)
+}
+
+func TestIntoReturnsCCError(t *testing.T) {
+	s := newServer(t, http.StatusOK, reply{Code: 1101101, ErrMsg: "instance not found"})
+
+	err := newClient().DoPost(context.Background(), s.URL, httpclient.EmptyHeader, map[string]string{}).Into(new(reply))
+	require.True(t, httpclient.IsCCError(err))
+	coder, ok := err.(ccErr.CCErrorCoder)
+	require.True(t, ok)
+	require.Equal(t, 1101101, coder.GetCode())
+	require.Equal(t, "instance not found", coder.Error())
+}
+
+func TestIntoReturnsTransportError(t *testing.T) {
+	s := newServer(t, http.StatusInternalServerError, reply{Code: 1, ErrMsg: "internal error"})
+	c := newClient()
+
+	r := c.DoPut(context.Background(), s.URL, httpclient.EmptyHeader, map[string]string{})
+	require.Equal(t, http.StatusInternalServerError, r.StatusCode)
+	err := r.Into(new(reply))
+	require.False(t, httpclient.IsCCError(err))
+	httpErr, ok := err.(httpclient.HttpError)
+	require.True(t, ok)
+	require.Equal(t, int32(http.StatusInternalServerError), httpErr.StatusCode())
+
+	s.Close()
+	r = c.DoPost(context.Background(), s.URL, httpclient.EmptyHeader, map[string]string{})
+	require.NotNil(t, r)
+	require.Error(t, r.Err)
+	err = r.Into(new(reply))
+	require.Error(t, err)
+	require.False(t, httpclient.IsCCError(err))
+}
+
+func TestIntoKeepsOtherEnvelopes(t *testing.T) {
+	s := newServer(t, http.StatusOK, map[string]interface{}{"code": 0, "data": true})
+
+	var resp struct {
+		Code int  `json:"code"`
+		Data bool `json:"data"`
+	}
+	require.NoError(t, newClient().DoGet(context.Background(), s.URL, httpclient.EmptyHeader, httpclient.EmptyQuery).Into(&resp))
+	require.True(t, resp.Data)
+}
@@ -0,0 +1,41 @@
+package httpclient
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"carizon-device-plugin/pkg/metrics"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// observe 记录请求的耗时和结果，请求失败时code为error
+func observe(method, rawURL string, start time.Time, resp *resty.Response, err error) {
+	duration := time.Since(start)
+	api := apiPath(rawURL)
+	code := "error"
+	if err == nil && resp != nil {
+		code = strconv.Itoa(resp.StatusCode())
+	}
+	metrics.CmdbRequests.WithLabelValues(method, api, code).Inc()
+	metrics.CmdbRequestDuration.WithLabelValues(method, api).Observe(duration.Seconds())
+
+	recordExchange(method, rawURL, start, duration, resp, err)
+}
+
+// apiPath 返回url的路径，数字路径段替换为{id}，避免指标标签过多
+func apiPath(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "unknown"
+	}
+	segments := strings.Split(u.Path, "/")
+	for i, s := range segments {
+		if _, err := strconv.ParseInt(s, 10, 64); err == nil {
+			segments[i] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,34 @@
+package httpclient_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	httpclient "carizon-device-plugin/pkg/client"
+	"carizon-device-plugin/pkg/metrics"
+)
+
+func TestRequestMetricsNormalizePath(t *testing.T) {
+	s := newServer(t, http.StatusOK, reply{Result: true})
+
+	for _, tc := range []struct {
+		path string
+		api  string
+	}{
+		{"/api/v3/hosts", "/api/v3/hosts"},
+		{"/api/v3/host/318", "/api/v3/host/{id}"},
+		{"/api/v3/host/318/device/7?fields=ip", "/api/v3/host/{id}/device/{id}"},
+		{"/api/v3/host/j5-318", "/api/v3/host/j5-318"},
+	} {
+		requests := metrics.CmdbRequests.WithLabelValues(http.MethodGet, tc.api, "200")
+		before := testutil.ToFloat64(requests)
+
+		r := newClient().DoGet(context.Background(), s.URL+tc.path, httpclient.EmptyHeader, httpclient.EmptyQuery)
+		require.NoError(t, r.Err)
+		require.Equal(t, before+1, testutil.ToFloat64(requests), tc.path)
+	}
+}
@@ -0,0 +1,60 @@
+package httpclient
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+const (
+	// maxRecentExchanges 保留的最近请求数
+	maxRecentExchanges = 50
+	// maxExchangeBodySize 保留的响应body最大长度
+	maxExchangeBodySize = 4096
+)
+
+// Exchange 一次请求及其响应，用于调试
+type Exchange struct {
+	Time       time.Time     `json:"time"`
+	Method     string        `json:"method"`
+	URL        string        `json:"url"`
+	Duration   time.Duration `json:"duration"`
+	StatusCode int           `json:"status_code,omitempty"`
+	Body       string        `json:"body,omitempty"`
+	Error      string        `json:"error,omitempty"`
+}
+
+var (
+	recentLock      sync.RWMutex
+	recentExchanges []Exchange
+)
+
+func recordExchange(method, url string, start time.Time, duration time.Duration, resp *resty.Response, err error) {
+	e := Exchange{Time: start, Method: method, URL: url, Duration: duration}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if resp != nil {
+		e.StatusCode = resp.StatusCode()
+		body := resp.Body()
+		if len(body) > maxExchangeBodySize {
+			body = body[:maxExchangeBodySize]
+		}
+		e.Body = string(body)
+	}
+
+	recentLock.Lock()
+	defer recentLock.Unlock()
+	recentExchanges = append(recentExchanges, e)
+	if len(recentExchanges) > maxRecentExchanges {
+		recentExchanges = recentExchanges[len(recentExchanges)-maxRecentExchanges:]
+	}
+}
+
+// RecentExchanges 返回最近的请求，最新的在最后
+func RecentExchanges() []Exchange {
+	recentLock.RLock()
+	defer recentLock.RUnlock()
+	return append([]Exchange{}, recentExchanges...)
+}
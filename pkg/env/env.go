@@ -85,9 +85,9 @@ var (
 	LogLevel = "debug"
 )
 
-// Init 从环境变量中获取服务的基础配置信息
+// Init 从环境变量中获取服务的基础配置信息，服务启动时先于nacos.Init调用，APP_NAME缺失时退出进程
 // TODO: 从配置中心获取服务配置
-func init() {
+func Init() {
 	getDefaultConfFromEnv()
 }
 
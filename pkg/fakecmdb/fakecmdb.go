@@ -0,0 +1,409 @@
+/*
+Package fakecmdb
+
+进程内的CMDB模拟服务，基于httptest实现设备插件使用的CMDB接口，数据保存在内存中并可以在测试中修改，
+用于离线测试设备发现、分配和健康检查
+*/
+package fakecmdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"carizon-device-plugin/metadata"
+	"carizon-device-plugin/pkg/mapstr"
+)
+
+// 模拟的接口，用于注入错误和统计请求
+const (
+	APIFindInstAssociation = "find/instassociation"
+	APISearchInsts         = "search/instances/object"
+	APIUpdateInsts         = "updatemany/instance/object"
+	APIDeviceHealthy       = "device/healthy"
+	APIListDevices         = "list/devices"
+
+	apiPrefix = "/api/v3/"
+
+	// HostObjectID 主机模型ID
+	HostObjectID = "host"
+	// FieldInstID 实例ID字段
+	FieldInstID = "bk_inst_id"
+	// FieldInstName 实例名称字段
+	FieldInstName = "bk_inst_name"
+	// FieldIP 设备IP字段
+	FieldIP = "ip"
+	// FieldVNetIP 设备的vnet IP字段，list/devices接口返回设置了该字段的设备
+	FieldVNetIP = "vnet_ip"
+
+	// ErrCodeNotFound 实例不存在的错误码
+	ErrCodeNotFound = 1101101
+	// ErrCodeLimitExceeded 批量更新超过BKMaxLimitSize的错误码
+	ErrCodeLimitExceeded = 1199077
+)
+
+// failure 注入的错误，Status非0时返回该http状态码，否则返回result为false的业务错误
+type failure struct {
+	Status int
+	Code   int
+	Msg    string
+}
+
+// Server 内存中的CMDB
+type Server struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	nextID   int64
+	objects  map[string]map[int64]mapstr.MapStr
+	assts    []metadata.InstAsst
+	healthy  map[int64]bool
+	failures map[string]failure
+	requests map[string]int
+}
+
+// NewServer 启动模拟的CMDB，使用完后需要调用Close
+func NewServer() *Server {
+	s := &Server{
+		nextID:   1,
+		objects:  make(map[string]map[int64]mapstr.MapStr),
+		healthy:  make(map[int64]bool),
+		failures: make(map[string]failure),
+		requests: make(map[string]int),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// AddHost 添加主机实例，返回实例ID
+func (s *Server) AddHost(name string) int64 {
+	return s.AddInstance(HostObjectID, mapstr.MapStr{FieldInstName: name})
+}
+
+// AddInstance 添加模型实例，返回实例ID
+func (s *Server) AddInstance(objID string, attrs mapstr.MapStr) int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	id := s.nextID
+	s.nextID++
+	inst := attrs.Clone()
+	inst[FieldInstID] = id
+	if s.objects[objID] == nil {
+		s.objects[objID] = make(map[int64]mapstr.MapStr)
+	}
+	s.objects[objID][id] = inst
+	return id
+}
+
+// AddDevice 添加设备实例并关联到主机，返回实例ID
+func (s *Server) AddDevice(objID string, hostID int64, attrs mapstr.MapStr) int64 {
+	id := s.AddInstance(objID, attrs)
+	s.Associate(hostID, objID, id)
+	return id
+}
+
+// Associate 关联主机和设备实例
+func (s *Server) Associate(hostID int64, objID string, instID int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.assts = append(s.assts, metadata.InstAsst{
+		ID:           int64(len(s.assts) + 1),
+		ObjectID:     HostObjectID,
+		InstID:       hostID,
+		AsstObjectID: objID,
+		AsstInstID:   instID,
+	})
+}
+
+// Instance 返回实例的副本，实例不存在时返回nil
+func (s *Server) Instance(objID string, id int64) mapstr.MapStr {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if inst, ok := s.objects[objID][id]; ok {
+		return inst.Clone()
+	}
+	return nil
+}
+
+// SetAttrs 修改实例的属性
+func (s *Server) SetAttrs(objID string, id int64, attrs mapstr.MapStr) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if inst, ok := s.objects[objID][id]; ok {
+		inst.Merge(attrs)
+	}
+}
+
+// RemoveInstance 删除实例及其关联
+func (s *Server) RemoveInstance(objID string, id int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.objects[objID], id)
+	assts := s.assts[:0]
+	for _, a := range s.assts {
+		if !(a.AsstObjectID == objID && a.AsstInstID == id) {
+			assts = append(assts, a)
+		}
+	}
+	s.assts = assts
+}
+
+// SetHealthy 设置device/{id}/healthy接口返回的设备健康状态，默认健康
+func (s *Server) SetHealthy(id int64, healthy bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.healthy[id] = healthy
+}
+
+// FailHTTP 使接口返回http错误，status为0时恢复正常
+func (s *Server) FailHTTP(api string, status int) {
+	s.setFailure(api, failure{Status: status})
+}
+
+// FailResult 使接口返回result为false的业务错误，code为0时恢复正常
+func (s *Server) FailResult(api string, code int, msg string) {
+	s.setFailure(api, failure{Code: code, Msg: msg})
+}
+
+func (s *Server) setFailure(api string, f failure) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if f.Status == 0 && f.Code == 0 {
+		delete(s.failures, api)
+		return
+	}
+	s.failures[api] = f
+}
+
+// Requests 返回接口被请求的次数
+func (s *Server) Requests(api string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.requests[api]
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, apiPrefix)
+	api, arg := route(path)
+	if api == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.requests[api]++
+	if f, ok := s.failures[api]; ok {
+		if f.Status != 0 {
+			http.Error(w, http.StatusText(f.Status), f.Status)
+			return
+		}
+		if api == APIDeviceHealthy || api == APIListDevices {
+			// the device endpoints have their own envelope
+			writeJSON(w, codeResp(f.Code, f.Msg, nil))
+			return
+		}
+		writeJSON(w, errorResp(f.Code, f.Msg))
+		return
+	}
+
+	switch api {
+	case APIFindInstAssociation:
+		s.findInstAssociation(w, r)
+	case APISearchInsts:
+		s.searchInsts(w, r, arg)
+	case APIUpdateInsts:
+		s.updateInsts(w, r, arg)
+	case APIDeviceHealthy:
+		s.deviceHealthy(w, arg)
+	case APIListDevices:
+		s.listDevices(w, r)
+	}
+}
+
+// route 返回请求路径对应的接口和路径参数
+func route(path string) (string, string) {
+	switch {
+	case path == APIFindInstAssociation:
+		return APIFindInstAssociation, ""
+	case path == APIListDevices:
+		return APIListDevices, ""
+	case strings.HasPrefix(path, APISearchInsts+"/"):
+		return APISearchInsts, strings.TrimPrefix(path, APISearchInsts+"/")
+	case strings.HasPrefix(path, APIUpdateInsts+"/"):
+		return APIUpdateInsts, strings.TrimPrefix(path, APIUpdateInsts+"/")
+	case strings.HasPrefix(path, "device/") && strings.HasSuffix(path, "/healthy"):
+		return APIDeviceHealthy, strings.TrimSuffix(strings.TrimPrefix(path, "device/"), "/healthy")
+	}
+	return "", ""
+}
+
+func (s *Server) findInstAssociation(w http.ResponseWriter, r *http.Request) {
+	req := new(metadata.SearchAssociationInstRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	objID, _ := req.Condition.String(metadata.AssociationFieldObjectID)
+	asstObjID, _ := req.Condition.String(metadata.AssociationFieldAssociationObjectID)
+	instID, err := req.Condition.Int64(FieldInstID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	data := []*metadata.InstAsst{}
+	for i := range s.assts {
+		a := s.assts[i]
+		if a.ObjectID == objID && a.InstID == instID && (asstObjID == "" || a.AsstObjectID == asstObjID) {
+			data = append(data, &a)
+		}
+	}
+	writeJSON(w, metadata.SearchAssociationInstResult{BaseResp: metadata.BaseResp{Result: true}, Data: data})
+}
+
+func (s *Server) searchInsts(w http.ResponseWriter, r *http.Request, objID string) {
+	req := new(metadata.CommonSearchFilter)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var ids []int64
+	for id := range s.objects[objID] {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	info := []mapstr.MapStr{}
+	for _, id := range ids {
+		inst := s.objects[objID][id]
+		ok, err := matchAll(inst, req.Conditions)
+		if err != nil {
+			writeJSON(w, errorResp(http.StatusBadRequest, err.Error()))
+			return
+		}
+		if ok {
+			info = append(info, project(inst, req.Fields))
+		}
+	}
+
+	start, limit := req.Page.Start, req.Page.Limit
+	total := len(info)
+	if start > total {
+		start = total
+	}
+	info = info[start:]
+	if limit > 0 && limit < len(info) {
+		info = info[:limit]
+	}
+	writeJSON(w, metadata.SearchResp{
+		BaseResp: metadata.BaseResp{Result: true},
+		Data:     metadata.SearchDataResult{Count: int64(total), Info: info},
+	})
+}
+
+func (s *Server) updateInsts(w http.ResponseWriter, r *http.Request, objID string) {
+	req := new(metadata.OpCondition)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Update) > metadata.BKMaxLimitSize {
+		writeJSON(w, errorResp(ErrCodeLimitExceeded, fmt.Sprintf("exceed max limit size: %d", metadata.BKMaxLimitSize)))
+		return
+	}
+
+	// the update is atomic, nothing is updated when an instance is missing
+	for _, u := range req.Update {
+		if _, ok := s.objects[objID][u.InstID]; !ok {
+			writeJSON(w, errorResp(ErrCodeNotFound, fmt.Sprintf("instance %d of %s not found", u.InstID, objID)))
+			return
+		}
+	}
+	for _, u := range req.Update {
+		s.objects[objID][u.InstID].Merge(u.InstInfo)
+	}
+	writeJSON(w, metadata.Response{BaseResp: metadata.BaseResp{Result: true}})
+}
+
+func (s *Server) deviceHealthy(w http.ResponseWriter, arg string) {
+	id, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	healthy, ok := s.healthy[id]
+	if !ok {
+		healthy = true
+	}
+	writeJSON(w, codeResp(0, "", healthy))
+}
+
+// listDevices 返回请求的IP中设置了vnet IP的设备
+func (s *Server) listDevices(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		IPs []string `json:"ips"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	vnetIPs := make(map[string]string)
+	for _, insts := range s.objects {
+		for _, inst := range insts {
+			ip, _ := inst.String(FieldIP)
+			vnetIP, _ := inst.String(FieldVNetIP)
+			if ip != "" && vnetIP != "" {
+				vnetIPs[ip] = vnetIP
+			}
+		}
+	}
+
+	data := []map[string]string{}
+	for _, ip := range req.IPs {
+		if vnetIP, ok := vnetIPs[ip]; ok {
+			data = append(data, map[string]string{FieldIP: ip, FieldVNetIP: vnetIP})
+		}
+	}
+	writeJSON(w, codeResp(0, "", data))
+}
+
+// codeResp 返回device接口的返回格式
+func codeResp(code int, msg string, data interface{}) map[string]interface{} {
+	return map[string]interface{}{"code": code, "err_msg": msg, "err_user_msg": msg, "data": data}
+}
+
+func errorResp(code int, msg string) metadata.Response {
+	return metadata.Response{BaseResp: metadata.BaseResp{Result: false, Code: code, ErrMsg: msg}}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// project 返回只包含fields字段的实例，fields为空时返回全部字段
+func project(inst mapstr.MapStr, fields []string) mapstr.MapStr {
+	if len(fields) == 0 {
+		return inst.Clone()
+	}
+	result := mapstr.MapStr{}
+	for _, f := range fields {
+		if v, ok := inst[f]; ok {
+			result[f] = v
+		}
+	}
+	return result
+}
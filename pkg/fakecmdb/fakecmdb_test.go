@@ -0,0 +1,196 @@
+package fakecmdb_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"carizon-device-plugin/metadata"
+	"carizon-device-plugin/pkg/fakecmdb"
+	"carizon-device-plugin/pkg/mapstr"
+)
+
+func do(t *testing.T, s *fakecmdb.Server, method, path string, body, resp interface{}) int {
+	data, err := json.Marshal(body)
+	require.NoError(t, err)
+	req, err := http.NewRequest(method, s.URL+"/api/v3/"+path, bytes.NewReader(data))
+	require.NoError(t, err)
+	r, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer r.Body.Close()
+	if r.StatusCode == http.StatusOK {
+		require.NoError(t, json.NewDecoder(r.Body).Decode(resp))
+	}
+	return r.StatusCode
+}
+
+func search(t *testing.T, s *fakecmdb.Server, objID string, rules []metadata.AtomRule, fields []string) *metadata.SearchResp {
+	resp := new(metadata.SearchResp)
+	do(t, s, http.MethodPost, "search/instances/object/"+objID, &metadata.CommonSearchFilter{
+		ObjectID:   objID,
+		Conditions: &metadata.CombinedRule{Condition: "AND", Rules: rules},
+		Fields:     fields,
+		Page:       metadata.BasePage{Limit: metadata.BKNoLimit},
+	}, resp)
+	return resp
+}
+
+func TestFindInstAssociation(t *testing.T) {
+	s := fakecmdb.NewServer()
+	defer s.Close()
+
+	host := s.AddHost("node-1")
+	other := s.AddHost("node-2")
+	d1 := s.AddDevice("J5", host, mapstr.MapStr{"ip": "10.0.0.1"})
+	s.AddDevice("J5", other, mapstr.MapStr{"ip": "10.0.0.2"})
+	s.AddDevice("J3", host, mapstr.MapStr{"ip": "10.0.0.3"})
+
+	resp := new(metadata.SearchAssociationInstResult)
+	do(t, s, http.MethodPost, "find/instassociation", &metadata.SearchAssociationInstRequest{
+		ObjID: "host",
+		Condition: mapstr.MapStr{
+			metadata.AssociationFieldObjectID:            "host",
+			"bk_inst_id":                                 host,
+			metadata.AssociationFieldAssociationObjectID: "J5",
+		},
+	}, resp)
+
+	require.True(t, resp.Result)
+	require.Len(t, resp.Data, 1)
+	require.Equal(t, d1, resp.Data[0].AsstInstID)
+	require.Equal(t, 1, s.Requests(fakecmdb.APIFindInstAssociation))
+}
+
+func TestSearchInsts(t *testing.T) {
+	s := fakecmdb.NewServer()
+	defer s.Close()
+
+	host := s.AddHost("node-1")
+	d1 := s.AddDevice("J5", host, mapstr.MapStr{"ip": "10.0.0.1", "status": 0})
+	d2 := s.AddDevice("J5", host, mapstr.MapStr{"ip": "10.0.0.2", "status": 1})
+	s.AddDevice("J5", host, mapstr.MapStr{"ip": "10.0.0.3", "status": 0})
+
+	resp := search(t, s, "J5", []metadata.AtomRule{
+		{Field: "bk_inst_id", Operator: "in", Value: []int64{d1, d2}},
+	}, []string{"ip"})
+	require.True(t, resp.Result)
+	require.Len(t, resp.Data.Info, 2)
+	require.Equal(t, mapstr.MapStr{"ip": "10.0.0.1"}, resp.Data.Info[0])
+
+	resp = search(t, s, "J5", []metadata.AtomRule{
+		{Field: "ip", Operator: "in", Value: []string{"10.0.0.2", "10.0.0.3"}},
+		{Field: "status", Operator: "equal", Value: 0},
+	}, nil)
+	require.Len(t, resp.Data.Info, 1)
+	ip, err := resp.Data.Info[0].String("ip")
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.3", ip)
+
+	resp = search(t, s, "host", []metadata.AtomRule{
+		{Field: "bk_inst_name", Operator: "equal", Value: "node-1"},
+	}, []string{"bk_inst_id"})
+	require.Len(t, resp.Data.Info, 1)
+	id, err := resp.Data.Info[0].Int64("bk_inst_id")
+	require.NoError(t, err)
+	require.Equal(t, host, id)
+}
+
+func TestUpdateInsts(t *testing.T) {
+	s := fakecmdb.NewServer()
+	defer s.Close()
+
+	host := s.AddHost("node-1")
+	d1 := s.AddDevice("J5", host, mapstr.MapStr{"ip": "10.0.0.1"})
+
+	resp := new(metadata.Response)
+	do(t, s, http.MethodPut, "updatemany/instance/object/J5", &metadata.OpCondition{
+		Update: []metadata.UpdateCondition{{InstID: d1, InstInfo: map[string]interface{}{"is_reserved": 1}}},
+	}, resp)
+	require.True(t, resp.Result)
+	reserved, err := s.Instance("J5", d1).Int64("is_reserved")
+	require.NoError(t, err)
+	require.Equal(t, int64(1), reserved)
+
+	// missing instances fail the whole update
+	resp = new(metadata.Response)
+	do(t, s, http.MethodPut, "updatemany/instance/object/J5", &metadata.OpCondition{
+		Update: []metadata.UpdateCondition{
+			{InstID: d1, InstInfo: map[string]interface{}{"is_reserved": 0}},
+			{InstID: 999, InstInfo: map[string]interface{}{"is_reserved": 0}},
+		},
+	}, resp)
+	require.False(t, resp.Result)
+	require.Equal(t, fakecmdb.ErrCodeNotFound, resp.Code)
+	reserved, _ = s.Instance("J5", d1).Int64("is_reserved")
+	require.Equal(t, int64(1), reserved)
+
+	// updates are limited to BKMaxLimitSize instances
+	var updates []metadata.UpdateCondition
+	for i := 0; i <= metadata.BKMaxLimitSize; i++ {
+		updates = append(updates, metadata.UpdateCondition{InstID: d1})
+	}
+	resp = new(metadata.Response)
+	do(t, s, http.MethodPut, "updatemany/instance/object/J5", &metadata.OpCondition{Update: updates}, resp)
+	require.False(t, resp.Result)
+	require.Equal(t, fakecmdb.ErrCodeLimitExceeded, resp.Code)
+}
+
+func TestDeviceHealthyAndFailures(t *testing.T) {
+	s := fakecmdb.NewServer()
+	defer s.Close()
+
+	host := s.AddHost("node-1")
+	d1 := s.AddDevice("J5", host, mapstr.MapStr{"ip": "10.0.0.1"})
+
+	var resp struct {
+		Code int  `json:"code"`
+		Data bool `json:"data"`
+	}
+	path := fmt.Sprintf("device/%d/healthy", d1)
+	do(t, s, http.MethodGet, path, nil, &resp)
+	require.True(t, resp.Data)
+
+	s.SetHealthy(d1, false)
+	do(t, s, http.MethodGet, path, nil, &resp)
+	require.False(t, resp.Data)
+
+	s.FailHTTP(fakecmdb.APISearchInsts, http.StatusInternalServerError)
+	require.Equal(t, http.StatusInternalServerError, do(t, s, http.MethodPost, "search/instances/object/J5", &metadata.CommonSearchFilter{}, nil))
+
+	s.FailHTTP(fakecmdb.APISearchInsts, 0)
+	s.FailResult(fakecmdb.APISearchInsts, 1199000, "boom")
+	sr := search(t, s, "J5", nil, nil)
+	require.False(t, sr.Result)
+	require.Equal(t, 1199000, sr.Code)
+	require.Equal(t, "boom", sr.ErrMsg)
+}
+
+func TestListDevices(t *testing.T) {
+	s := fakecmdb.NewServer()
+	defer s.Close()
+
+	host := s.AddHost("node-1")
+	s.AddDevice("J5", host, mapstr.MapStr{"ip": "10.0.0.1", "vnet_ip": "192.168.0.1"})
+	s.AddDevice("J5", host, mapstr.MapStr{"ip": "10.0.0.2"})
+
+	var resp struct {
+		Code int `json:"code"`
+		Data []struct {
+			IP     string `json:"ip"`
+			VNetIP string `json:"vnet_ip"`
+		} `json:"data"`
+	}
+	do(t, s, http.MethodPost, "list/devices", map[string][]string{"ips": {"10.0.0.1", "10.0.0.2"}}, &resp)
+	require.Equal(t, 0, resp.Code)
+	require.Len(t, resp.Data, 1)
+	require.Equal(t, "10.0.0.1", resp.Data[0].IP)
+	require.Equal(t, "192.168.0.1", resp.Data[0].VNetIP)
+
+	s.FailResult(fakecmdb.APIListDevices, 500, "unavailable")
+	do(t, s, http.MethodPost, "list/devices", map[string][]string{"ips": {"10.0.0.1"}}, &resp)
+	require.Equal(t, 500, resp.Code)
+}
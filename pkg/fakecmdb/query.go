@@ -0,0 +1,92 @@
+package fakecmdb
+
+import (
+	"fmt"
+	"strconv"
+
+	"carizon-device-plugin/metadata"
+	"carizon-device-plugin/pkg/mapstr"
+)
+
+// matchAll 实例是否满足条件，只支持AND组合的条件
+func matchAll(inst mapstr.MapStr, rule *metadata.CombinedRule) (bool, error) {
+	if rule == nil {
+		return true, nil
+	}
+	if rule.Condition != "" && rule.Condition != metadata.Condition("AND") {
+		return false, fmt.Errorf("unsupported condition: %s", rule.Condition)
+	}
+	for _, r := range rule.Rules {
+		ok, err := match(inst[r.Field], r.Operator, r.Value)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func match(value interface{}, op metadata.Operator, expected interface{}) (bool, error) {
+	switch op {
+	case "equal":
+		return equal(value, expected), nil
+	case "not_equal":
+		return !equal(value, expected), nil
+	case "in", "not_in":
+		values, ok := expected.([]interface{})
+		if !ok {
+			return false, fmt.Errorf("operator %s needs an array value", op)
+		}
+		found := false
+		for _, v := range values {
+			if equal(value, v) {
+				found = true
+				break
+			}
+		}
+		return found == (op == "in"), nil
+	case "less", "less_or_equal", "greater", "greater_or_equal":
+		a, aok := number(value)
+		b, bok := number(expected)
+		if !aok || !bok {
+			return false, nil
+		}
+		switch op {
+		case "less":
+			return a < b, nil
+		case "less_or_equal":
+			return a <= b, nil
+		case "greater":
+			return a > b, nil
+		default:
+			return a >= b, nil
+		}
+	}
+	return false, fmt.Errorf("unsupported operator: %s", op)
+}
+
+func equal(a, b interface{}) bool {
+	if x, ok := number(a); ok {
+		if y, ok := number(b); ok {
+			return x == y
+		}
+	}
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,102 @@
+/*
+Package metrics
+
+定义设备插件的Prometheus指标，包括设备分配、CMDB请求、定时对账和配置重载
+*/
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Namespace 所有指标的前缀
+const Namespace = "carizon_device_plugin"
+
+var (
+	// AllocateRequests Allocate调用次数，result为success或error
+	AllocateRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "allocate_requests_total",
+		Help:      "Number of Allocate calls by resource and result.",
+	}, []string{"resource", "result"})
+
+	// AllocateDuration Allocate调用耗时
+	AllocateDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "allocate_duration_seconds",
+		Help:      "Latency of Allocate calls by resource.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"resource"})
+
+	// CmdbRequests CMDB请求次数，code为http状态码，请求失败时为error
+	CmdbRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "cmdb_requests_total",
+		Help:      "Number of cmdb requests by method, api and status code.",
+	}, []string{"method", "api", "code"})
+
+	// CmdbRequestDuration CMDB请求耗时
+	CmdbRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "cmdb_request_duration_seconds",
+		Help:      "Latency of cmdb requests by method and api.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "api"})
+
+	// ReconcileRuns 定时对账设备占用的次数，result为success或error
+	ReconcileRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "reconcile_runs_total",
+		Help:      "Number of device reservation reconciliations by result.",
+	}, []string{"result"})
+
+	// ReconcileLastSuccess 最近一次对账成功的时间戳
+	ReconcileLastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Name:      "reconcile_last_success_timestamp_seconds",
+		Help:      "Unix time of the last successful device reservation reconciliation.",
+	})
+
+	// DeviceDrift 插件设备与kubelet可分配设备的差异数，kind为unknown(kubelet可分配但插件未上报)或missing(插件上报健康但kubelet不可分配)
+	DeviceDrift = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Name:      "device_drift",
+		Help:      "Number of devices differing between the plugin and the allocatable devices of kubelet by resource and kind.",
+	}, []string{"resource", "kind"})
+
+	// ConfigReloads 配置重载次数
+	ConfigReloads = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "config_reloads_total",
+		Help:      "Number of config reloads.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		AllocateRequests,
+		AllocateDuration,
+		CmdbRequests,
+		CmdbRequestDuration,
+		ReconcileRuns,
+		ReconcileLastSuccess,
+		DeviceDrift,
+		ConfigReloads,
+	)
+}
+
+// Result 根据err返回指标的result标签
+func Result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+// Handler 返回/metrics的http handler
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
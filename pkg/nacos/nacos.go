@@ -15,12 +15,14 @@ import (
 	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
 
 	"github.com/pelletier/go-toml"
 
 	"gopkg.in/yaml.v2"
 
 	"carizon-device-plugin/pkg/env"
+	"carizon-device-plugin/pkg/metrics"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/nacos-group/nacos-sdk-go/clients"
@@ -92,6 +94,28 @@ var (
 
 var v *viper.Viper
 
+var (
+	changeHooksLock sync.RWMutex
+	changeHooks     []func(conf interface{})
+)
+
+// OnConfigChange 注册配置变更的回调，在配置文件变更后调用
+// 回调参数为新反序列化的配置对象，是与Init传入的conf同类型的指针，Init未传入conf时为nil
+// Init传入的配置对象只在Init中反序列化一次，之后不会被修改，避免和读取配置的协程竞争
+func OnConfigChange(hook func(conf interface{})) {
+	changeHooksLock.Lock()
+	defer changeHooksLock.Unlock()
+	changeHooks = append(changeHooks, hook)
+}
+
+func runChangeHooks(conf interface{}) {
+	changeHooksLock.RLock()
+	defer changeHooksLock.RUnlock()
+	for _, hook := range changeHooks {
+		hook(conf)
+	}
+}
+
 // 监听本地配置文件
 func watchLocalFile(fileName, configType, configSuffix string, conf interface{}) {
 	v = viper.New()
@@ -105,12 +129,17 @@ func watchLocalFile(fileName, configType, configSuffix string, conf interface{})
 	v.AutomaticEnv()
 	v.WatchConfig()
 	v.OnConfigChange(func(in fsnotify.Event) {
+		// 反序列化到新的配置对象，由回调决定如何替换当前配置
+		var changed interface{}
 		if conf != nil {
-			err := unmarshalStruct(filepath.Join(env.ConfPath, fileName+configSuffix), conf)
+			changed = reflect.New(reflect.TypeOf(conf).Elem()).Interface()
+			err := unmarshalStruct(filepath.Join(env.ConfPath, fileName+configSuffix), changed)
 			if err != nil {
 				log.Fatal("viper unmarshall error: " + err.Error())
 			}
 		}
+		metrics.ConfigReloads.Inc()
+		runChangeHooks(changed)
 	})
 }
 
@@ -0,0 +1,191 @@
+/*
+Package prober
+
+设备网络存活探测，支持tcp建连、udp echo和http GET，可以通过Register扩展新的探测方式
+*/
+package prober
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// TypeTCP probes a device by connecting to a tcp port
+	TypeTCP = "tcp"
+	// TypeUDP probes a device by sending an udp datagram and waiting for the echo
+	TypeUDP = "udp"
+	// TypeHTTP probes a device by sending a http GET request
+	TypeHTTP = "http"
+
+	defaultTimeout     = 3 * time.Second
+	defaultUDPPort     = 7
+	defaultUDPPayload  = "carizon-probe"
+	defaultHTTPPort    = 80
+	defaultHTTPPath    = "/"
+	maxUDPResponseSize = 1024
+)
+
+// Config describes how a device is probed
+type Config struct {
+	Type    string
+	Port    int
+	Path    string
+	Payload string
+	Timeout time.Duration
+}
+
+// Prober checks whether a device IP is reachable
+type Prober interface {
+	Probe(ctx context.Context, ip string) error
+}
+
+// Factory creates a Prober from the config
+type Factory func(cfg Config) (Prober, error)
+
+var (
+	factoriesLock sync.RWMutex
+	factories     = map[string]Factory{
+		TypeTCP:  newTCPProber,
+		TypeUDP:  newUDPProber,
+		TypeHTTP: newHTTPProber,
+	}
+)
+
+// Register registers a prober factory for the probe type
+func Register(probeType string, factory Factory) {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+	factories[probeType] = factory
+}
+
+// New returns the Prober of the configured probe type
+func New(cfg Config) (Prober, error) {
+	factoriesLock.RLock()
+	factory, ok := factories[cfg.Type]
+	factoriesLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown probe type: %s", cfg.Type)
+	}
+
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+	return factory(cfg)
+}
+
+type tcpProber struct {
+	port    int
+	timeout time.Duration
+}
+
+func newTCPProber(cfg Config) (Prober, error) {
+	if cfg.Port <= 0 {
+		return nil, fmt.Errorf("tcp probe requires a port")
+	}
+	return &tcpProber{port: cfg.Port, timeout: cfg.Timeout}, nil
+}
+
+// Probe connects to the tcp port of the device
+func (p *tcpProber) Probe(ctx context.Context, ip string) error {
+	d := net.Dialer{Timeout: p.timeout}
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(ip, strconv.Itoa(p.port)))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+type udpProber struct {
+	port    int
+	payload []byte
+	timeout time.Duration
+}
+
+func newUDPProber(cfg Config) (Prober, error) {
+	p := &udpProber{port: cfg.Port, payload: []byte(cfg.Payload), timeout: cfg.Timeout}
+	if p.port <= 0 {
+		p.port = defaultUDPPort
+	}
+	if len(p.payload) == 0 {
+		p.payload = []byte(defaultUDPPayload)
+	}
+	return p, nil
+}
+
+// Probe sends the payload to the udp port of the device and waits for the echo
+func (p *udpProber) Probe(ctx context.Context, ip string) error {
+	d := net.Dialer{Timeout: p.timeout}
+	conn, err := d.DialContext(ctx, "udp", net.JoinHostPort(ip, strconv.Itoa(p.port)))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(p.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+
+	if _, err := conn.Write(p.payload); err != nil {
+		return err
+	}
+	buf := make([]byte, maxUDPResponseSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(buf[:n], p.payload) {
+		return fmt.Errorf("unexpected udp echo from %s: %q", ip, buf[:n])
+	}
+	return nil
+}
+
+type httpProber struct {
+	port   int
+	path   string
+	client *http.Client
+}
+
+func newHTTPProber(cfg Config) (Prober, error) {
+	p := &httpProber{port: cfg.Port, path: cfg.Path, client: &http.Client{Timeout: cfg.Timeout}}
+	if p.port <= 0 {
+		p.port = defaultHTTPPort
+	}
+	if p.path == "" {
+		p.path = defaultHTTPPath
+	}
+	return p, nil
+}
+
+// Probe sends a GET request to the device, any status below 400 is alive
+func (p *httpProber) Probe(ctx context.Context, ip string) error {
+	url := "http://" + net.JoinHostPort(ip, strconv.Itoa(p.port)) + p.path
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("http probe %s status: %s", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package prober_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"carizon-device-plugin/pkg/prober"
+
+	"github.com/stretchr/testify/require"
+)
+
+func splitHostPort(t *testing.T, addr string) (string, int) {
+	host, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+	p, err := strconv.Atoi(port)
+	require.NoError(t, err)
+	return host, p
+}
+
+func TestTCPProbe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	host, port := splitHostPort(t, l.Addr().String())
+
+	p, err := prober.New(prober.Config{Type: prober.TypeTCP, Port: port, Timeout: time.Second})
+	require.NoError(t, err)
+	require.NoError(t, p.Probe(context.Background(), host))
+
+	l.Close()
+	require.Error(t, p.Probe(context.Background(), host))
+
+	_, err = prober.New(prober.Config{Type: prober.TypeTCP})
+	require.Error(t, err)
+}
+
+func TestUDPProbe(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	host, port := splitHostPort(t, conn.LocalAddr().String())
+
+	p, err := prober.New(prober.Config{Type: prober.TypeUDP, Port: port, Timeout: time.Second})
+	require.NoError(t, err)
+	require.NoError(t, p.Probe(context.Background(), host))
+
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer silent.Close()
+	_, port = splitHostPort(t, silent.LocalAddr().String())
+
+	p, err = prober.New(prober.Config{Type: prober.TypeUDP, Port: port, Timeout: 100 * time.Millisecond})
+	require.NoError(t, err)
+	require.Error(t, p.Probe(context.Background(), host))
+}
+
+func TestHTTPProbe(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	host, port := splitHostPort(t, srv.Listener.Addr().String())
+
+	p, err := prober.New(prober.Config{Type: prober.TypeHTTP, Port: port, Path: "/healthz"})
+	require.NoError(t, err)
+	require.NoError(t, p.Probe(context.Background(), host))
+
+	p, err = prober.New(prober.Config{Type: prober.TypeHTTP, Port: port, Path: "/missing"})
+	require.NoError(t, err)
+	require.Error(t, p.Probe(context.Background(), host))
+}
+
+func TestUnknownProbe(t *testing.T) {
+	_, err := prober.New(prober.Config{Type: "icmp"})
+	require.Error(t, err)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"reflect"
+
+	"carizon-device-plugin/conf"
+	"carizon-device-plugin/pkg/logger"
+)
+
+// resourceSpec is a configured resource or sub resource together with the
+// resource names of its ancestors
+type resourceSpec struct {
+	resource  conf.Resource
+	ancestors []string
+}
+
+// getResourceSpecs flattens the resources and all their sub resources. Sub
+// resources inherit the node filter of their parent if they have none.
+func getResourceSpecs(resources []conf.Resource, parentFilter conf.Filter, ancestors []string) []resourceSpec {
+	var specs []resourceSpec
+	for _, t := range resources {
+		if t.Filter.NodeName == "" {
+			t.Filter.NodeName = parentFilter.NodeName
+		}
+		specs = append(specs, resourceSpec{resource: t, ancestors: ancestors})
+
+		subAncestors := append(append([]string{}, ancestors...), resourceDomain+t.ResourceName)
+		specs = append(specs, getResourceSpecs(t.SubResource, t.Filter, subAncestors)...)
+	}
+	return specs
+}
+
+func getAllPlugins() []*CarizonDevicePlugin {
+	specs := getResourceSpecs(conf.Get().ResourceDevices, conf.Filter{}, nil)
+	plugins := []*CarizonDevicePlugin{}
+	for _, s := range specs {
+		p, err := newResourcePlugin(s.resource)
+		if err != nil {
+			logger.Wrapper.Errorf("[main] Create plugin error: %s", err.Error())
+			continue
+		}
+		plugins = append(plugins, p)
+	}
+	linkPlugins(plugins, specs)
+	return plugins
+}
+
+func newResourcePlugin(t conf.Resource) (*CarizonDevicePlugin, error) {
+	if err := validateProbe(t); err != nil {
+		return nil, err
+	}
+	rm, err := NewResourceManager(t)
+	if err != nil {
+		return nil, err
+	}
+	return NewCarizonDevicePlugin(
+		resourceDomain+t.ResourceName,
+		rm,
+		"CARIZON_DEVICE_"+t.ResourceName+"_IP_LIST",
+		devicePluginPath+"carizon_"+t.ResourceName+".sock",
+		t), nil
+}
+
+// linkPlugins links the plugin of every sub resource to the plugins of its ancestors
+func linkPlugins(plugins []*CarizonDevicePlugin, specs []resourceSpec) {
+	byName := make(map[string]*CarizonDevicePlugin, len(plugins))
+	for _, p := range plugins {
+		p.Unlink()
+		byName[p.resourceName] = p
+	}
+
+	for _, s := range specs {
+		p := byName[resourceDomain+s.resource.ResourceName]
+		for _, a := range s.ancestors {
+			if ap, ok := byName[a]; ok && p != nil {
+				p.Link(ap)
+			}
+		}
+	}
+}
+
+// sameResource reports whether two resource definitions are the same, ignoring
+// their sub resources which are served by their own plugins. Not only a changed
+// filter restarts a plugin: the backend, health checks, discovery and the
+// options registered with kubelet are all set up when the plugin starts, so
+// any change of the resource needs a restart to take effect.
+func sameResource(a, b conf.Resource) bool {
+	a.SubResource, b.SubResource = nil, nil
+	return reflect.DeepEqual(a, b)
+}
+
+// reconcilePlugins reconciles the supervised plugins with the configured
+// resources. Plugins of new resources are started, plugins of removed resources
+// are stopped and only the plugins whose resource definition changed (see
+// sameResource) are restarted, the others keep serving.
+func reconcilePlugins(s *PluginSupervisor, specs []resourceSpec) {
+	current := make(map[string]*CarizonDevicePlugin)
+	for _, p := range s.Plugins() {
+		current[p.resourceName] = p
+	}
+
+	var (
+		plugins []*CarizonDevicePlugin
+		started []*CarizonDevicePlugin
+	)
+	for _, spec := range specs {
+		name := resourceDomain + spec.resource.ResourceName
+		p, ok := current[name]
+		if !ok || !sameResource(p.resource, spec.resource) {
+			np, err := newResourcePlugin(spec.resource)
+			if err != nil {
+				// keep serving the previous definition, if any
+				logger.Wrapper.Errorf("[reconcile] Create plugin error: %s", err.Error())
+			} else if !ok {
+				logger.Wrapper.Infof("[reconcile] New resource %s.", name)
+				p = np
+				started = append(started, p)
+			} else {
+				logger.Wrapper.Infof("[reconcile] Resource %s changed, restarting.", name)
+				s.Remove(name)
+				p = np
+				started = append(started, p)
+			}
+		}
+		delete(current, name)
+		if p != nil {
+			plugins = append(plugins, p)
+		}
+	}
+
+	for name := range current {
+		logger.Wrapper.Infof("[reconcile] Resource %s removed, stopping.", name)
+		s.Remove(name)
+	}
+
+	linkPlugins(plugins, specs)
+	for _, p := range started {
+		s.Add(p)
+	}
+}
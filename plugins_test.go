@@ -0,0 +1,114 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"carizon-device-plugin/conf"
+)
+
+const testBackend = "stub"
+
+func init() {
+	RegisterBackend(testBackend, func(resource conf.Resource) (ResourceManager, error) {
+		return newStubManager("10.0.0.1"), nil
+	})
+}
+
+func TestReconcilePlugins(t *testing.T) {
+	k := newFakeKubelet(t)
+	s := newTestSupervisor(t)
+
+	a := conf.Resource{ResourceName: "A", Backend: testBackend}
+	b := conf.Resource{ResourceName: "B", Backend: testBackend}
+	c := conf.Resource{ResourceName: "C", Backend: testBackend}
+
+	// watch waits for the registrations of the resources and opens their ListAndWatch streams
+	watch := func(names ...string) map[string]<-chan []*pluginapi.Device {
+		streams := make(map[string]<-chan []*pluginapi.Device)
+		for range names {
+			r := k.waitRegistered(t)
+			updates := k.watch(t, k.connect(t, r))
+			nextUpdate(t, updates)
+			streams[r.ResourceName] = updates
+		}
+		for _, name := range names {
+			require.Contains(t, streams, resourceDomain+name)
+		}
+		return streams
+	}
+	plugins := func() map[string]*CarizonDevicePlugin {
+		byName := make(map[string]*CarizonDevicePlugin)
+		for _, p := range s.Plugins() {
+			byName[p.resourceName] = p
+		}
+		return byName
+	}
+	requireOpen := func(updates <-chan []*pluginapi.Device) {
+		select {
+		case _, ok := <-updates:
+			require.True(t, ok, "ListAndWatch stream closed")
+		default:
+		}
+	}
+
+	reconcilePlugins(s, getResourceSpecs([]conf.Resource{a, b}, conf.Filter{}, nil))
+	streams := watch("A", "B")
+	before := plugins()
+	require.Len(t, before, 2)
+
+	// B changed and C added, A keeps serving
+	b.DiscoveryInterval = time.Minute
+	reconcilePlugins(s, getResourceSpecs([]conf.Resource{a, b, c}, conf.Filter{}, nil))
+	waitClosed(t, streams[resourceDomain+"B"])
+	for name, updates := range watch("B", "C") {
+		streams[name] = updates
+	}
+	after := plugins()
+	require.Len(t, after, 3)
+	require.Same(t, before[resourceDomain+"A"], after[resourceDomain+"A"])
+	require.NotSame(t, before[resourceDomain+"B"], after[resourceDomain+"B"])
+	require.Equal(t, time.Minute, after[resourceDomain+"B"].resource.DiscoveryInterval)
+	requireOpen(streams[resourceDomain+"A"])
+
+	// B and C removed
+	reconcilePlugins(s, getResourceSpecs([]conf.Resource{a}, conf.Filter{}, nil))
+	waitClosed(t, streams[resourceDomain+"B"])
+	waitClosed(t, streams[resourceDomain+"C"])
+	require.Equal(t, []*CarizonDevicePlugin{before[resourceDomain+"A"]}, s.Plugins())
+	requireOpen(streams[resourceDomain+"A"])
+
+	select {
+	case r := <-k.registered:
+		t.Fatalf("unexpected registration of %s", r.ResourceName)
+	default:
+	}
+}
+
+func TestGetAllPluginsWhileConfigChanges(t *testing.T) {
+	prev := conf.Get()
+	defer conf.Set(prev)
+	config := conf.Config{ResourceDevices: []conf.Resource{
+		{ResourceName: "A", Backend: testBackend, SubResource: []conf.Resource{{ResourceName: "A-camera", Backend: testBackend}}},
+	}}
+	conf.Set(config)
+
+	// config changes are applied while the plugins read the config
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			conf.Set(config)
+		}
+	}()
+	plugins := getAllPlugins()
+	<-done
+
+	require.Len(t, plugins, 2)
+	require.Equal(t, resourceDomain+"A", plugins[0].resourceName)
+	require.Equal(t, resourceDomain+"A-camera", plugins[1].resourceName)
+	require.Equal(t, []*CarizonDevicePlugin{plugins[0]}, plugins[1].linkedPlugins())
+}
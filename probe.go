@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"carizon-device-plugin/conf"
+	"carizon-device-plugin/pkg/logger"
+	"carizon-device-plugin/pkg/prober"
+)
+
+const defaultProbeFailureThreshold = 3
+
+// deviceProber actively probes the device IPs. A device is reported unhealthy
+// after failureThreshold consecutive failed probes and healthy again after the
+// first successful one.
+type deviceProber struct {
+	prober           prober.Prober
+	failureThreshold int
+	failures         map[string]int
+}
+
+func newDeviceProber(cfg conf.Probe) (*deviceProber, error) {
+	p, err := prober.New(prober.Config{
+		Type:    cfg.Type,
+		Port:    cfg.Port,
+		Path:    cfg.Path,
+		Payload: cfg.Payload,
+		Timeout: cfg.Timeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	threshold := cfg.FailureThreshold
+	if threshold <= 0 {
+		threshold = defaultProbeFailureThreshold
+	}
+	return &deviceProber{prober: p, failureThreshold: threshold, failures: make(map[string]int)}, nil
+}
+
+// devicesHealth probes all devices concurrently. Devices which failed fewer
+// than failureThreshold times in a row are left out of the result.
+func (p *deviceProber) devicesHealth(devices []*Device) (map[string]bool, error) {
+	results := make([]error, len(devices))
+	var wg sync.WaitGroup
+	for i, d := range devices {
+		wg.Add(1)
+		go func(i int, ip string) {
+			defer wg.Done()
+			results[i] = p.prober.Probe(context.Background(), ip)
+		}(i, d.IP)
+	}
+	wg.Wait()
+
+	health := make(map[string]bool, len(devices))
+	for i, d := range devices {
+		if results[i] == nil {
+			delete(p.failures, d.IP)
+			health[d.IP] = true
+			continue
+		}
+
+		p.failures[d.IP]++
+		logger.Wrapper.Debugf("Probe device %s failed %d times: %v", d.IP, p.failures[d.IP], results[i])
+		if p.failures[d.IP] >= p.failureThreshold {
+			health[d.IP] = false
+		}
+	}
+	return health, nil
+}
+
+// validateProbe checks the probe config of the resource, a resource with an
+// invalid one is rejected instead of silently running without probes
+func validateProbe(resource conf.Resource) error {
+	if resource.Probe.Type == "" {
+		return nil
+	}
+	if _, err := newDeviceProber(resource.Probe); err != nil {
+		return fmt.Errorf("invalid probe config of resource %s: %v", resource.ResourceName, err)
+	}
+	return nil
+}
+
+// healthChecks returns the cmdb independent health checks configured for the resource
+func healthChecks(resource conf.Resource) []devicesHealthFunc {
+	var checks []devicesHealthFunc
+	if resource.Probe.Type != "" {
+		p, err := newDeviceProber(resource.Probe)
+		if err != nil {
+			logger.Wrapper.Errorf("Invalid probe config of %s: %v", resource.ResourceName, err)
+		} else {
+			checks = append(checks, p.devicesHealth)
+		}
+	}
+	return checks
+}
+
+// combineHealth reports a device healthy only when none of the checks reports
+// it unhealthy. A failing check is skipped so that the others still take effect.
+func combineHealth(checks ...devicesHealthFunc) devicesHealthFunc {
+	return func(devices []*Device) (map[string]bool, error) {
+		var errs []string
+		health := make(map[string]bool)
+		for _, check := range checks {
+			result, err := check(devices)
+			if err != nil {
+				errs = append(errs, err.Error())
+			}
+			for ip, ok := range result {
+				if prev, found := health[ip]; found {
+					ok = ok && prev
+				}
+				health[ip] = ok
+			}
+		}
+
+		if len(errs) != 0 {
+			return health, errors.New(strings.Join(errs, "; "))
+		}
+		return health, nil
+	}
+}
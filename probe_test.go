@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"carizon-device-plugin/conf"
+)
+
+// fakeProber fails the probes of the IPs in down
+type fakeProber struct {
+	down map[string]bool
+}
+
+func (p *fakeProber) Probe(ctx context.Context, ip string) error {
+	if p.down[ip] {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func TestDeviceProberFailureThreshold(t *testing.T) {
+	devices := []*Device{newTestDevice(1, "10.0.0.1"), newTestDevice(2, "10.0.0.2")}
+	fake := &fakeProber{}
+	p := &deviceProber{prober: fake, failureThreshold: 3, failures: make(map[string]int)}
+
+	for _, step := range []struct {
+		name   string
+		down   map[string]bool
+		health map[string]bool
+	}{
+		{"all up", nil, map[string]bool{"10.0.0.1": true, "10.0.0.2": true}},
+		{"first failure", map[string]bool{"10.0.0.1": true}, map[string]bool{"10.0.0.2": true}},
+		{"second failure", map[string]bool{"10.0.0.1": true}, map[string]bool{"10.0.0.2": true}},
+		{"threshold reached", map[string]bool{"10.0.0.1": true}, map[string]bool{"10.0.0.1": false, "10.0.0.2": true}},
+		{"still down", map[string]bool{"10.0.0.1": true}, map[string]bool{"10.0.0.1": false, "10.0.0.2": true}},
+		{"healthy after one success", nil, map[string]bool{"10.0.0.1": true, "10.0.0.2": true}},
+		{"failures start over", map[string]bool{"10.0.0.1": true}, map[string]bool{"10.0.0.2": true}},
+	} {
+		fake.down = step.down
+		health, err := p.devicesHealth(devices)
+		require.NoError(t, err, step.name)
+		require.Equal(t, step.health, health, step.name)
+	}
+}
+
+func TestCombineHealth(t *testing.T) {
+	devices := []*Device{newTestDevice(1, "10.0.0.1"), newTestDevice(2, "10.0.0.2")}
+	check := func(health map[string]bool, err error) devicesHealthFunc {
+		return func([]*Device) (map[string]bool, error) { return health, err }
+	}
+	cmdbDown := errors.New("cmdb unavailable")
+
+	for _, tc := range []struct {
+		name   string
+		checks []devicesHealthFunc
+		health map[string]bool
+		err    string
+	}{
+		{
+			name:   "no checks",
+			health: map[string]bool{},
+		},
+		{
+			name: "all healthy",
+			checks: []devicesHealthFunc{
+				check(map[string]bool{"10.0.0.1": true, "10.0.0.2": true}, nil),
+				check(map[string]bool{"10.0.0.1": true, "10.0.0.2": true}, nil),
+			},
+			health: map[string]bool{"10.0.0.1": true, "10.0.0.2": true},
+		},
+		{
+			name: "unhealthy in one check",
+			checks: []devicesHealthFunc{
+				check(map[string]bool{"10.0.0.1": true, "10.0.0.2": false}, nil),
+				check(map[string]bool{"10.0.0.1": false, "10.0.0.2": true}, nil),
+			},
+			health: map[string]bool{"10.0.0.1": false, "10.0.0.2": false},
+		},
+		{
+			name: "left out by a check",
+			checks: []devicesHealthFunc{
+				check(map[string]bool{"10.0.0.1": true, "10.0.0.2": true}, nil),
+				check(map[string]bool{"10.0.0.2": false}, nil),
+			},
+			health: map[string]bool{"10.0.0.1": true, "10.0.0.2": false},
+		},
+		{
+			// devices stay healthy while cmdb is down, the probe still takes effect
+			name: "cmdb error",
+			checks: []devicesHealthFunc{
+				check(nil, cmdbDown),
+				check(map[string]bool{"10.0.0.1": true, "10.0.0.2": false}, nil),
+			},
+			health: map[string]bool{"10.0.0.1": true, "10.0.0.2": false},
+			err:    "cmdb unavailable",
+		},
+		{
+			name: "every check failed",
+			checks: []devicesHealthFunc{
+				check(nil, cmdbDown),
+				check(nil, errors.New("probe failed")),
+			},
+			health: map[string]bool{},
+			err:    "cmdb unavailable; probe failed",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			health, err := combineHealth(tc.checks...)(devices)
+			require.Equal(t, tc.health, health)
+			if tc.err == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, tc.err)
+			}
+		})
+	}
+}
+
+func TestInvalidProbeConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		probe conf.Probe
+		err   string
+	}{
+		{"no probe", conf.Probe{}, ""},
+		{"tcp", conf.Probe{Type: "tcp", Port: 22}, ""},
+		{"udp default port", conf.Probe{Type: "udp"}, ""},
+		{"tcp without port", conf.Probe{Type: "tcp"}, "invalid probe config of resource J5: tcp probe requires a port"},
+		{"unknown type", conf.Probe{Type: "icmp"}, "invalid probe config of resource J5: unknown probe type: icmp"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newResourcePlugin(conf.Resource{ResourceName: "J5", Backend: backendFile, Probe: tc.probe})
+			if tc.err == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, tc.err)
+			}
+		})
+	}
+}
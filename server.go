@@ -12,36 +12,67 @@ import (
 	"sync"
 	"time"
 
+	"carizon-device-plugin/conf"
 	"carizon-device-plugin/pkg/logger"
+	"carizon-device-plugin/pkg/metrics"
 
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	v1 "k8s.io/api/core/v1"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
+var (
+	// kubeletSocket is the registration socket of kubelet
+	kubeletSocket = pluginapi.KubeletSocket
+	// devicePluginPath is the directory of the kubelet and plugin sockets
+	devicePluginPath = pluginapi.DevicePluginPath
+)
+
 // CarizonDevicePlugin implements the Kubernetes device plugin API
 type CarizonDevicePlugin struct {
 	ResourceManager
 	resourceName  string
 	deviceListEnv string
 	socket        string
+	resource      conf.Resource
 
 	server        *grpc.Server
 	cachedDevices []*Device
 	health        chan *Device
 	unhealth      chan *Device
 	stop          chan interface{}
+	update        chan struct{}
+	healthStop    chan interface{}
+
+	// linked are the plugins of the parent and sub resources, taken are the
+	// devices allocated through them which are unavailable in this plugin
+	linked []*CarizonDevicePlugin
+	taken  map[string]time.Time
+	// retired are the devices no longer discovered but still held by pods
+	retired map[string]bool
+	// healthState is the health of the cached devices keyed by device ID, checked
+	// are the device copies owned by the running health check keyed by device ID
+	healthState map[string]string
+	checked     map[string]*Device
+	// registeredAt is when kubelet accepted the registration, watchers is the
+	// number of open ListAndWatch streams
+	registeredAt time.Time
+	watchers     int
 	sync.RWMutex
 }
 
 // NewCarizonDevicePlugin returns an initialized CarizonDevicePlugin
-func NewCarizonDevicePlugin(resourceName string, resourceManager ResourceManager, deviceListEnv string, socket string) *CarizonDevicePlugin {
+func NewCarizonDevicePlugin(resourceName string, resourceManager ResourceManager, deviceListEnv string, socket string, resource conf.Resource) *CarizonDevicePlugin {
 
 	return &CarizonDevicePlugin{
 		ResourceManager: resourceManager,
 		resourceName:    resourceName,
 		deviceListEnv:   deviceListEnv,
 		socket:          socket,
+		resource:        resource,
+		taken:           make(map[string]time.Time),
+		retired:         make(map[string]bool),
 
 		// These will be reinitialized every
 		// time the plugin server is restarted.
@@ -50,20 +81,31 @@ func NewCarizonDevicePlugin(resourceName string, resourceManager ResourceManager
 		health:        nil,
 		unhealth:      nil,
 		stop:          nil,
+		update:        nil,
 	}
 }
 
-func (h *CarizonDevicePlugin) initialize() {
-	h.cachedDevices = h.Devices()
-	h.server = grpc.NewServer([]grpc.ServerOption{}...)
+func (h *CarizonDevicePlugin) initialize() error {
+	devices, err := h.Devices()
+	if err != nil {
+		return err
+	}
+
+	h.setCachedDevices(devices)
+	h.Lock()
+	h.retired = make(map[string]bool)
 	h.health = make(chan *Device)
 	h.unhealth = make(chan *Device)
 	h.stop = make(chan interface{})
+	h.update = make(chan struct{}, 1)
+	h.Unlock()
+	h.server = grpc.NewServer([]grpc.ServerOption{}...)
+	return nil
 }
 
 // Register registers the device plugin for the given resourceName with Kubelet.
 func (h *CarizonDevicePlugin) Register() error {
-	conn, err := h.dial(pluginapi.KubeletSocket, 5*time.Second)
+	conn, err := h.dial(kubeletSocket, 5*time.Second)
 	if err != nil {
 		return err
 	}
@@ -85,19 +127,34 @@ func (h *CarizonDevicePlugin) Register() error {
 
 func (h *CarizonDevicePlugin) cleanup() {
 	close(h.stop)
+	h.Lock()
+	if h.healthStop != nil {
+		close(h.healthStop)
+		h.healthStop = nil
+	}
 	h.cachedDevices = nil
-	h.server = nil
+	h.checked = nil
+	h.registeredAt = time.Time{}
 	h.health = nil
 	h.unhealth = nil
 	h.stop = nil
+	h.update = nil
+	h.Unlock()
+	h.server = nil
 }
 
 // Start starts the gRPC server, registers the device plugin with the Kubelet,
 // and starts the device healthchecks.
 func (h *CarizonDevicePlugin) Start() error {
-	h.initialize()
+	err := h.initialize()
+	if err != nil {
+		log.Printf("Could not discover devices for '%s': %s", h.resourceName, err)
+		return err
+	}
+	// the devices held through the linked resources are unavailable from the start
+	syncLinkedPodResources([]*CarizonDevicePlugin{h})
 
-	err := h.Serve()
+	err = h.Serve()
 	if err != nil {
 		log.Printf("Could not start device plugin for '%s': %s", h.resourceName, err)
 		h.cleanup()
@@ -112,8 +169,13 @@ func (h *CarizonDevicePlugin) Start() error {
 		return err
 	}
 	log.Printf("Registered device plugin for '%s' with Kubelet", h.resourceName)
+	h.markRegistered()
 
-	go h.CheckHealth(h.stop, h.cachedDevices, h.health, h.unhealth)
+	h.startHealthCheck(h.stop, h.devices())
+	notifyNodeFeatures()
+	if interval := h.discoveryInterval(); interval > 0 {
+		go h.rediscover(h.stop, interval)
+	}
 
 	return nil
 }
@@ -162,19 +224,33 @@ func (h *CarizonDevicePlugin) Serve() error {
 
 // ListAndWatch lists devices and update that list according to the health status
 func (h *CarizonDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
+	h.addWatcher(1)
+	defer h.addWatcher(-1)
+	// the channels are reset when the plugin stops, keep the ones of this run
+	h.RLock()
+	stop, health, unhealth, update := h.stop, h.health, h.unhealth, h.update
+	h.RUnlock()
 	s.Send(&pluginapi.ListAndWatchResponse{Devices: h.apiDevices()})
 
 	for {
 		select {
-		case <-h.stop:
+		case <-stop:
 			return nil
-		case d := <-h.unhealth:
-			d.Health = pluginapi.Unhealthy
+		case d := <-unhealth:
+			if !h.setHealth(d, pluginapi.Unhealthy) {
+				continue
+			}
 			log.Printf("'%s' device marked unhealthy: %s", h.resourceName, d.IP)
+			go h.recordDeviceEvent(d, v1.EventTypeWarning, reasonDeviceUnhealthy)
 			s.Send(&pluginapi.ListAndWatchResponse{Devices: h.apiDevices()})
-		case d := <-h.health:
-			d.Health = pluginapi.Healthy
+		case d := <-health:
+			if !h.setHealth(d, pluginapi.Healthy) {
+				continue
+			}
 			log.Printf("'%s' device marked healthy: %s", h.resourceName, d.IP)
+			go h.recordDeviceEvent(d, v1.EventTypeNormal, reasonDeviceHealthy)
+			s.Send(&pluginapi.ListAndWatchResponse{Devices: h.apiDevices()})
+		case <-update:
 			s.Send(&pluginapi.ListAndWatchResponse{Devices: h.apiDevices()})
 		}
 	}
@@ -182,6 +258,18 @@ func (h *CarizonDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.Devic
 
 // Allocate responses resource request
 func (h *CarizonDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	start := time.Now()
+	resp, err := h.allocate(ctx, reqs)
+	metrics.AllocateRequests.WithLabelValues(h.resourceName, metrics.Result(err)).Inc()
+	metrics.AllocateDuration.WithLabelValues(h.resourceName).Observe(time.Since(start).Seconds())
+	recordAllocation(h.resourceName, reqs, err)
+	if err != nil {
+		recordNodeEvent(v1.EventTypeWarning, reasonAllocationFailed, "Allocate %s devices %v: %s", h.resourceName, allocateDeviceIDs(reqs), err.Error())
+	}
+	return resp, err
+}
+
+func (h *CarizonDevicePlugin) allocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
 	responses := pluginapi.AllocateResponse{}
 
 	logger.Wrapper.Infoln("----Allocating Carizon device is started----")
@@ -195,6 +283,7 @@ func (h *CarizonDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.Allo
 	for _, req := range reqs.ContainerRequests {
 		logger.Wrapper.Infof("Kubelet allocate deviceIDs:%+v", req.DevicesIDs)
 
+		var missing []string
 		if h.resourceName == resourceDomain {
 			pcieFlag = true
 
@@ -203,15 +292,23 @@ func (h *CarizonDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.Allo
 				logger.Wrapper.Errorf("pcieInfo err: %+v", err)
 				return nil, err
 			}
+			// the container still gets the devices, its agent decides what to do without their pcie info
+			if missing = missingPCIeInfo(req.DevicesIDs, *info); len(missing) > 0 {
+				logger.Wrapper.Errorf("No pcie info of '%s' devices: %v", h.resourceName, missing)
+				recordNodeEvent(v1.EventTypeWarning, reasonPCIeInfoMissing, "No pcie info of %s devices %v", h.resourceName, missing)
+			}
 		}
 
+		devices := make([]*Device, 0, len(req.DevicesIDs))
 		for _, id := range req.DevicesIDs {
-			if !h.deviceExists(id) {
+			d := h.device(id)
+			if d == nil {
 				return nil, fmt.Errorf("invalid allocation request for '%s': unknown device: %s", h.resourceName, id)
 			}
+			devices = append(devices, d)
 		}
 		//marshal device info
-		infoJSON, err := json.Marshal(PodReq{Device: strings.Join(req.DevicesIDs, ","), PCIeInfo: *info})
+		infoJSON, err := json.Marshal(newPodReq(req.DevicesIDs, *info, missing))
 		if err != nil {
 			return nil, fmt.Errorf("marshal info %+v error '%s'", info, err.Error())
 		}
@@ -223,8 +320,16 @@ func (h *CarizonDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.Allo
 				CarizonPcieFlagEnv:       strconv.FormatBool(pcieFlag),
 			},
 		}
+		response.Devices, response.Mounts, response.Annotations, err = buildAllocation(h.resource.Allocation, devices, req.DevicesIDs)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allocation template for '%s': %v", h.resourceName, err)
+		}
 		logger.Wrapper.Infof("the pcieinfo %s", string(infoJSON))
-		h.ResourceManager.Allocate(req.DevicesIDs)
+		// kubelet already assigned the devices, a failed reservation is retried by the reconciliation
+		if err := reservationError(h.ResourceManager.Allocate(req.DevicesIDs, Reservation{Node: NodeName, KeepOwner: true})); err != nil {
+			recordNodeEvent(v1.EventTypeWarning, reasonReservationFailed, "Reserve %s devices: %s", h.resourceName, err.Error())
+		}
+		h.takeLinked(req.DevicesIDs)
 
 		responses.ContainerResponses = append(responses.ContainerResponses, &response)
 	}
@@ -234,11 +339,53 @@ func (h *CarizonDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.Allo
 
 // GetDevicePluginOptions get CarizonDevicePlugin options
 func (h *CarizonDevicePlugin) GetDevicePluginOptions(context.Context, *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
-	return &pluginapi.DevicePluginOptions{}, nil
+	return &pluginapi.DevicePluginOptions{
+		PreStartRequired:                h.resource.PreStartRequired,
+		GetPreferredAllocationAvailable: true,
+	}, nil
+}
+
+// GetPreferredAllocation returns the preferred devices of each container request,
+// keeping devices that share a chip type, location or tag together
+func (h *CarizonDevicePlugin) GetPreferredAllocation(ctx context.Context, r *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
+	response := &pluginapi.PreferredAllocationResponse{}
+	composed := isComposedResource(h.resourceName)
+
+	for _, req := range r.ContainerRequests {
+		ids := preferredDevices(h.devices(), req.AvailableDeviceIDs, req.MustIncludeDeviceIDs, int(req.AllocationSize), composed)
+		logger.Wrapper.Infof("Preferred allocation for '%s': %+v", h.resourceName, ids)
+
+		response.ContainerResponses = append(response.ContainerResponses, &pluginapi.ContainerPreferredAllocationResponse{
+			DeviceIDs: ids,
+		})
+	}
+
+	return response, nil
 }
 
-// PreStartContainer  get CarizonDevicePlugin PreStartContainer
-func (h *CarizonDevicePlugin) PreStartContainer(context.Context, *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+// PreStartContainer re-checks the devices assigned to a container and leases them
+// before the container starts. It is only called by kubelet when pre_start_required is set.
+func (h *CarizonDevicePlugin) PreStartContainer(ctx context.Context, r *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+	if !h.resource.PreStartRequired {
+		return &pluginapi.PreStartContainerResponse{}, nil
+	}
+
+	logger.Wrapper.Infof("PreStart '%s' deviceIDs:%+v", h.resourceName, r.DevicesIDs)
+	for _, id := range r.DevicesIDs {
+		health, ok := h.deviceHealth(id)
+		if !ok {
+			return nil, fmt.Errorf("invalid pre-start request for '%s': unknown device: %s", h.resourceName, id)
+		}
+		if health != pluginapi.Healthy {
+			return nil, fmt.Errorf("invalid pre-start request for '%s': unhealthy device: %s", h.resourceName, id)
+		}
+	}
+
+	if err := h.ResourceManager.Lease(r.DevicesIDs); err != nil {
+		logger.Wrapper.Errorf("Failed to lease '%s' devices %+v: %v", h.resourceName, r.DevicesIDs, err)
+		return nil, err
+	}
+
 	return &pluginapi.PreStartContainerResponse{}, nil
 }
 
@@ -258,19 +405,84 @@ func (h *CarizonDevicePlugin) dial(unixSocketPath string, timeout time.Duration)
 	return c, nil
 }
 
-func (h *CarizonDevicePlugin) deviceExists(id string) bool {
+// devices returns the current device list
+func (h *CarizonDevicePlugin) devices() []*Device {
+	h.RLock()
+	defer h.RUnlock()
+	return h.cachedDevices
+}
+
+func (h *CarizonDevicePlugin) device(id string) *Device {
+	for _, d := range h.devices() {
+		if d.ID == id {
+			return d
+		}
+	}
+	return nil
+}
+
+// setCachedDevices replaces the cached devices, their health is taken from the devices
+func (h *CarizonDevicePlugin) setCachedDevices(devices []*Device) {
+	h.Lock()
+	defer h.Unlock()
+	h.cachedDevices = devices
+	h.healthState = make(map[string]string, len(devices))
+	for _, d := range devices {
+		h.healthState[d.ID] = d.Health
+	}
+}
+
+// setHealth sets the health of the device reported by the running health check.
+// Reports of a health check which has been restarted in the meantime are
+// ignored, it returns false for them.
+func (h *CarizonDevicePlugin) setHealth(d *Device, health string) bool {
+	h.Lock()
+	defer h.Unlock()
+	if h.checked[d.ID] != d {
+		return false
+	}
+	h.healthState[d.ID] = health
+	return true
+}
+
+// deviceHealth returns the health of the device, false if the device is unknown
+func (h *CarizonDevicePlugin) deviceHealth(id string) (string, bool) {
+	h.RLock()
+	defer h.RUnlock()
 	for _, d := range h.cachedDevices {
 		if d.ID == id {
-			return true
+			return h.healthState[id], true
 		}
 	}
-	return false
+	return "", false
 }
 
+// apiDevices returns the devices to report to kubelet, the devices taken
+// through a linked resource or retired are reported unhealthy so they can't be allocated
 func (h *CarizonDevicePlugin) apiDevices() []*pluginapi.Device {
+	h.RLock()
+	defer h.RUnlock()
+
 	var pdevs []*pluginapi.Device
 	for _, d := range h.cachedDevices {
-		pdevs = append(pdevs, &d.Device)
+		dev := d.Device
+		dev.Health = h.healthState[d.ID]
+		if _, taken := h.taken[d.ID]; taken || h.retired[d.ID] {
+			dev.Health = pluginapi.Unhealthy
+		}
+		pdevs = append(pdevs, &dev)
 	}
 	return pdevs
 }
+
+// notifyUpdate asks ListAndWatch to send the device list again
+func (h *CarizonDevicePlugin) notifyUpdate() {
+	h.RLock()
+	update := h.update
+	h.RUnlock()
+
+	select {
+	case update <- struct{}{}:
+	default:
+	}
+}
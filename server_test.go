@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/require"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"carizon-device-plugin/conf"
+	"carizon-device-plugin/pkg/mapstr"
+)
+
+func TestPluginRegistersAndAllocates(t *testing.T) {
+	k := newFakeKubelet(t)
+	m := newStubManager("10.0.0.1", "10.0.0.2")
+	p := newTestPlugin(k, m)
+	require.NoError(t, p.Start())
+	defer p.Stop()
+
+	r := k.waitRegistered(t)
+	require.Equal(t, pluginapi.Version, r.Version)
+	require.Equal(t, testResourceName, r.ResourceName)
+
+	client := k.connect(t, r)
+	updates := k.watch(t, client)
+	require.Equal(t, map[string]string{"10.0.0.1": pluginapi.Healthy, "10.0.0.2": pluginapi.Healthy}, nextUpdate(t, updates))
+
+	resp, err := client.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"10.0.0.2"}}},
+	})
+	require.NoError(t, err)
+	require.Len(t, resp.ContainerResponses, 1)
+	require.Equal(t, "10.0.0.2", resp.ContainerResponses[0].Envs[testDeviceEnv])
+	require.Equal(t, [][]string{{"10.0.0.2"}}, m.allocated)
+	require.JSONEq(t, `{"version": "v1", "device": "10.0.0.2", "pcie_info": [], "missing": []}`, resp.ContainerResponses[0].Envs[CarizonDevicePcieInfoEnv])
+
+	_, err = client.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"10.0.0.3"}}},
+	})
+	require.Error(t, err)
+}
+
+func TestAllocatePCIeInfo(t *testing.T) {
+	k := newFakeKubelet(t)
+	m := newStubManager("10.0.0.1", "10.0.0.2")
+	m.vnetIPs = map[string]string{"10.0.0.1": "192.168.0.1"}
+	p := newTestResourcePlugin(k, m, resourceDomain)
+	require.NoError(t, p.Start())
+	defer p.Stop()
+
+	client := k.connect(t, k.waitRegistered(t))
+	resp, err := client.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"10.0.0.1", "10.0.0.2"}}},
+	})
+	require.NoError(t, err)
+	envs := resp.ContainerResponses[0].Envs
+	require.Equal(t, "true", envs[CarizonPcieFlagEnv])
+	require.JSONEq(t, `{
+		"version": "v1",
+		"device": "10.0.0.1,10.0.0.2",
+		"pcie_info": [{"ip": "10.0.0.1", "vnet_ip": "192.168.0.1"}],
+		"missing": ["10.0.0.2"]
+	}`, envs[CarizonDevicePcieInfoEnv])
+}
+
+func TestPreStartContainer(t *testing.T) {
+	prev := NodeName
+	NodeName = "node-1"
+	defer func() { NodeName = prev }()
+
+	cmdb := newFakeCMDB(t)
+	node := cmdb.AddHost("node-1")
+	d1 := cmdb.AddDevice("J5", node, mapstr.MapStr{"ip": "10.0.0.1"})
+	cmdb.AddDevice("J5", node, mapstr.MapStr{"ip": "10.0.0.2"})
+	d3 := cmdb.AddDevice("J5", node, mapstr.MapStr{"ip": "10.0.0.3"})
+	d4 := cmdb.AddDevice("J5", node, mapstr.MapStr{"ip": "10.0.0.4"})
+
+	resource := conf.Resource{ResourceName: "J5", Filter: conf.Filter{NodeName: "node-1"}, PreStartRequired: true}
+	p := NewCarizonDevicePlugin("J5", NewCarizonDeviceManager(resource), testDeviceEnv, "", resource)
+	devices, err := p.Devices()
+	require.NoError(t, err)
+	devices[1].Health = pluginapi.Unhealthy
+	p.setCachedDevices(devices)
+	cmdb.RemoveInstance("J5", d3)
+	cmdb.SetAttrs("J5", d4, mapstr.MapStr{"is_reserved": 1, "reserved_node": "node-2"})
+
+	preStart := func(ids ...string) error {
+		_, err := p.PreStartContainer(context.Background(), &pluginapi.PreStartContainerRequest{DevicesIDs: ids})
+		return err
+	}
+	require.NoError(t, preStart("10.0.0.1"))
+	require.EqualValues(t, 1, cmdb.Instance("J5", d1)["is_reserved"])
+	require.Equal(t, "node-1", cmdb.Instance("J5", d1)["reserved_node"])
+
+	require.EqualError(t, preStart("10.0.0.1", "10.0.0.2"), "invalid pre-start request for 'J5': unhealthy device: 10.0.0.2")
+	require.EqualError(t, preStart("10.0.0.9"), "invalid pre-start request for 'J5': unknown device: 10.0.0.9")
+	require.EqualError(t, preStart("10.0.0.3"), "device 10.0.0.3 not found in cmdb")
+	require.EqualError(t, preStart("10.0.0.4"), "device 10.0.0.4 is reserved by node node-2")
+	require.Equal(t, "node-2", cmdb.Instance("J5", d4)["reserved_node"])
+
+	// nothing is checked when kubelet is not asked to call PreStartContainer
+	p.resource.PreStartRequired = false
+	require.NoError(t, preStart("10.0.0.4"))
+}
+
+func TestPluginReportsHealthFlips(t *testing.T) {
+	k := newFakeKubelet(t)
+	m := newStubManager("10.0.0.1", "10.0.0.2")
+	p := newTestPlugin(k, m)
+	require.NoError(t, p.Start())
+	defer p.Stop()
+
+	updates := k.watch(t, k.connect(t, k.waitRegistered(t)))
+	nextUpdate(t, updates)
+
+	// the metrics and the debug api read the devices while their health flips
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				p.apiDevices()
+				p.debugDevices()
+			}
+		}
+	}()
+
+	m.flip(t, "10.0.0.2", false)
+	require.Equal(t, map[string]string{"10.0.0.1": pluginapi.Healthy, "10.0.0.2": pluginapi.Unhealthy}, nextUpdate(t, updates))
+
+	m.flip(t, "10.0.0.2", true)
+	require.Equal(t, map[string]string{"10.0.0.1": pluginapi.Healthy, "10.0.0.2": pluginapi.Healthy}, nextUpdate(t, updates))
+}
+
+func TestPluginStopEndsListAndWatch(t *testing.T) {
+	k := newFakeKubelet(t)
+	p := newTestPlugin(k, newStubManager("10.0.0.1"))
+	require.NoError(t, p.Start())
+
+	updates := k.watch(t, k.connect(t, k.waitRegistered(t)))
+	nextUpdate(t, updates)
+
+	require.NoError(t, p.Stop())
+	waitClosed(t, updates)
+	_, err := os.Stat(p.socket)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestSupervisorReregistersAfterKubeletRestart(t *testing.T) {
+	k := newFakeKubelet(t)
+	s := newTestSupervisor(t, newTestPlugin(k, newStubManager("10.0.0.1")))
+
+	updates := k.watch(t, k.connect(t, k.waitRegistered(t)))
+	nextUpdate(t, updates)
+
+	handleFSEvent(s, fsnotify.Event{Name: kubeletSocket, Op: fsnotify.Create})
+	waitClosed(t, updates)
+	updates = k.watch(t, k.connect(t, k.waitRegistered(t)))
+	require.Equal(t, map[string]string{"10.0.0.1": pluginapi.Healthy}, nextUpdate(t, updates))
+}
+
+func TestSupervisorReregistersRemovedSocket(t *testing.T) {
+	k := newFakeKubelet(t)
+	p := newTestPlugin(k, newStubManager("10.0.0.1"))
+	s := newTestSupervisor(t, p)
+	k.waitRegistered(t)
+	waitState(t, s, PluginRunning)
+
+	require.NoError(t, os.Remove(p.socket))
+	handleFSEvent(s, fsnotify.Event{Name: p.socket, Op: fsnotify.Remove})
+
+	updates := k.watch(t, k.connect(t, k.waitRegistered(t)))
+	require.Equal(t, map[string]string{"10.0.0.1": pluginapi.Healthy}, nextUpdate(t, updates))
+}
+
+func TestSupervisorBacksOffFailedStart(t *testing.T) {
+	k := newFakeKubelet(t)
+	m := newStubManager("10.0.0.1")
+	m.setError(errors.New("discovery failed"))
+	s := newTestSupervisor(t, newTestPlugin(k, m))
+
+	waitState(t, s, PluginBackOff)
+	status := s.Status()[0]
+	require.Equal(t, 1, status.Failures)
+	require.Equal(t, "discovery failed", status.LastError)
+	require.NotNil(t, status.NextRetry)
+
+	m.setError(nil)
+	s.Restart(testResourceName)
+	k.waitRegistered(t)
+	waitState(t, s, PluginRunning)
+}
+
+// newTestSupervisor supervises the plugins until the end of the test
+func newTestSupervisor(t *testing.T, plugins ...*CarizonDevicePlugin) *PluginSupervisor {
+	s := NewPluginSupervisor()
+	for _, p := range plugins {
+		s.Add(p)
+	}
+	t.Cleanup(s.StopAll)
+	return s
+}
+
+func waitState(t *testing.T, s *PluginSupervisor, state PluginState) {
+	require.Eventually(t, func() bool {
+		return s.Status()[0].State == state
+	}, testTimeout, 10*time.Millisecond, "plugin is not %s", state)
+}
+
+func waitClosed(t *testing.T, updates <-chan []*pluginapi.Device) {
+	for {
+		select {
+		case _, ok := <-updates:
+			if !ok {
+				return
+			}
+		case <-time.After(testTimeout):
+			t.Fatal("ListAndWatch stream not closed")
+		}
+	}
+}
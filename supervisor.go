@@ -0,0 +1,226 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"carizon-device-plugin/pkg/logger"
+)
+
+const (
+	minRestartBackoff = time.Second
+	maxRestartBackoff = 5 * time.Minute
+)
+
+// PluginState is the supervision state of a plugin
+type PluginState string
+
+// plugin states
+const (
+	PluginStarting PluginState = "Starting"
+	PluginRunning  PluginState = "Running"
+	PluginBackOff  PluginState = "BackOff"
+	PluginStopped  PluginState = "Stopped"
+)
+
+// PluginStatus reports the state of a supervised plugin
+type PluginStatus struct {
+	ResourceName string      `json:"resource_name"`
+	State        PluginState `json:"state"`
+	Since        time.Time   `json:"since"`
+	Failures     int         `json:"failures"`
+	LastError    string      `json:"last_error,omitempty"`
+	NextRetry    *time.Time  `json:"next_retry,omitempty"`
+}
+
+// supervisedPlugin runs a plugin in its own goroutine
+type supervisedPlugin struct {
+	plugin  *CarizonDevicePlugin
+	restart chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+
+	sync.RWMutex
+	status PluginStatus
+}
+
+// PluginSupervisor owns the plugins. Every plugin is started and restarted on
+// its own with an exponential backoff, so one failing plugin never disturbs
+// the plugins which are serving.
+type PluginSupervisor struct {
+	sync.RWMutex
+	plugins []*supervisedPlugin
+}
+
+// NewPluginSupervisor returns an empty PluginSupervisor
+func NewPluginSupervisor() *PluginSupervisor {
+	return &PluginSupervisor{}
+}
+
+// Add starts supervising the plugin
+func (s *PluginSupervisor) Add(p *CarizonDevicePlugin) {
+	sp := &supervisedPlugin{
+		plugin:  p,
+		restart: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		status:  PluginStatus{ResourceName: p.resourceName, State: PluginStopped, Since: time.Now()},
+	}
+
+	s.Lock()
+	s.plugins = append(s.plugins, sp)
+	s.Unlock()
+
+	go sp.run()
+}
+
+// Remove stops the plugin of the resource and waits until it is stopped
+func (s *PluginSupervisor) Remove(resourceName string) {
+	s.Lock()
+	var removed *supervisedPlugin
+	for i, sp := range s.plugins {
+		if sp.plugin.resourceName == resourceName {
+			removed = sp
+			s.plugins = append(s.plugins[:i], s.plugins[i+1:]...)
+			break
+		}
+	}
+	s.Unlock()
+
+	if removed != nil {
+		close(removed.stop)
+		<-removed.done
+	}
+}
+
+// Restart restarts the plugin of the resource right away
+func (s *PluginSupervisor) Restart(resourceName string) {
+	s.RLock()
+	defer s.RUnlock()
+	for _, sp := range s.plugins {
+		if sp.plugin.resourceName == resourceName {
+			sp.requestRestart()
+		}
+	}
+}
+
+// RestartAll restarts all the plugins right away
+func (s *PluginSupervisor) RestartAll() {
+	s.RLock()
+	defer s.RUnlock()
+	for _, sp := range s.plugins {
+		sp.requestRestart()
+	}
+}
+
+// StopAll stops all the plugins and waits until they are stopped
+func (s *PluginSupervisor) StopAll() {
+	s.Lock()
+	plugins := s.plugins
+	s.plugins = nil
+	s.Unlock()
+
+	for _, sp := range plugins {
+		close(sp.stop)
+	}
+	for _, sp := range plugins {
+		<-sp.done
+	}
+}
+
+// Plugins returns the supervised plugins
+func (s *PluginSupervisor) Plugins() []*CarizonDevicePlugin {
+	s.RLock()
+	defer s.RUnlock()
+	plugins := make([]*CarizonDevicePlugin, 0, len(s.plugins))
+	for _, sp := range s.plugins {
+		plugins = append(plugins, sp.plugin)
+	}
+	return plugins
+}
+
+// Status returns the status of every supervised plugin
+func (s *PluginSupervisor) Status() []PluginStatus {
+	s.RLock()
+	defer s.RUnlock()
+	status := make([]PluginStatus, 0, len(s.plugins))
+	for _, sp := range s.plugins {
+		sp.RLock()
+		status = append(status, sp.status)
+		sp.RUnlock()
+	}
+	return status
+}
+
+func (sp *supervisedPlugin) requestRestart() {
+	select {
+	case sp.restart <- struct{}{}:
+	default:
+	}
+}
+
+func (sp *supervisedPlugin) setState(state PluginState, err error, nextRetry *time.Time) {
+	sp.Lock()
+	defer sp.Unlock()
+
+	if state == PluginRunning {
+		sp.status.Failures = 0
+	}
+	if err != nil {
+		sp.status.Failures++
+		sp.status.LastError = err.Error()
+	}
+	if state != sp.status.State {
+		logger.Wrapper.Infof("[supervisor] Plugin %s: %s -> %s", sp.status.ResourceName, sp.status.State, state)
+		sp.status.State = state
+		sp.status.Since = time.Now()
+	}
+	sp.status.NextRetry = nextRetry
+}
+
+func (sp *supervisedPlugin) failures() int {
+	sp.RLock()
+	defer sp.RUnlock()
+	return sp.status.Failures
+}
+
+func (sp *supervisedPlugin) run() {
+	defer close(sp.done)
+
+	for {
+		sp.setState(PluginStarting, nil, nil)
+		sp.plugin.Stop()
+
+		var retry <-chan time.Time
+		if err := sp.plugin.Start(); err != nil {
+			backoff := restartBackoff(sp.failures() + 1)
+			next := time.Now().Add(backoff)
+			sp.setState(PluginBackOff, err, &next)
+			logger.Wrapper.Errorf("[supervisor] Start plugin %s error, retry in %s: %s", sp.plugin.resourceName, backoff, err.Error())
+			retry = time.After(backoff)
+		} else {
+			sp.setState(PluginRunning, nil, nil)
+		}
+
+		select {
+		case <-sp.stop:
+			sp.plugin.Stop()
+			sp.setState(PluginStopped, nil, nil)
+			return
+		case <-sp.restart:
+		case <-retry:
+		}
+	}
+}
+
+// restartBackoff returns the backoff after the given number of consecutive failures
+func restartBackoff(failures int) time.Duration {
+	backoff := minRestartBackoff
+	for i := 1; i < failures && backoff < maxRestartBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxRestartBackoff {
+		backoff = maxRestartBackoff
+	}
+	return backoff
+}
@@ -1,14 +1,20 @@
 package main
 
 import (
+	"fmt"
+	"strings"
 	"time"
 
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
 type externalDevice struct {
-	UUID int
-	IP   string
+	UUID          int
+	IP            string
+	ChipType      string
+	SystemVersion string
+	Location      string
+	Tags          string
 }
 
 // Device ...
@@ -23,10 +29,81 @@ type AllocateDeviceReq struct {
 	Allocated bool   `json:"allocated"`
 }
 
-// PodReq defines to update pod devices
+// DeviceOwner is the container holding a device, the fields unknown to the
+// source of the pod resources are empty
+type DeviceOwner struct {
+	PodUID        string `json:"pod_uid,omitempty"`
+	PodName       string `json:"pod_name,omitempty"`
+	PodNamespace  string `json:"pod_namespace,omitempty"`
+	ContainerName string `json:"container_name,omitempty"`
+}
+
+// Reservation is the owner recorded on the devices reserved in cmdb
+type Reservation struct {
+	Node string
+	DeviceOwner
+	// KeepOwner keeps the owner recorded before, kubelet doesn't know the pod when it allocates
+	KeepOwner bool
+}
+
+// ReservationResult is the result of reserving or releasing a device in cmdb
+type ReservationResult struct {
+	IP     string
+	InstID int64
+	Err    error
+}
+
+// reservationError returns an error listing the devices which failed, nil if none failed
+func reservationError(results []ReservationResult) error {
+	var failed []string
+	for _, r := range results {
+		if r.Err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", r.IP, r.Err))
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d of %d devices failed: %s", len(failed), len(results), strings.Join(failed, "; "))
+}
+
+// PCIeInfoVersion is the version of the PCIE_INFO schema, see deploy/pcie-info.schema.json.
+// It changes whenever a field is removed or its meaning changes.
+const PCIeInfoVersion = "v1"
+
+// PodReq is the PCIE_INFO passed to the container
 type PodReq struct {
+	Version  string            `json:"version"`
 	Device   string            `json:"device"`
 	PCIeInfo []PCIeAddressInfo `json:"pcie_info"`
+	// Missing are the allocated devices without pcie info
+	Missing []string `json:"missing"`
+}
+
+// newPodReq returns the PCIE_INFO of the devices
+func newPodReq(deviceIPs []string, info []PCIeAddressInfo, missing []string) PodReq {
+	if info == nil {
+		info = []PCIeAddressInfo{}
+	}
+	if missing == nil {
+		missing = []string{}
+	}
+	return PodReq{Version: PCIeInfoVersion, Device: strings.Join(deviceIPs, ","), PCIeInfo: info, Missing: missing}
+}
+
+// missingPCIeInfo returns the devices absent from the pcie info
+func missingPCIeInfo(deviceIPs []string, info []PCIeAddressInfo) []string {
+	found := make(map[string]bool, len(info))
+	for _, i := range info {
+		found[i.IP] = true
+	}
+	var missing []string
+	for _, ip := range deviceIPs {
+		if !found[ip] {
+			missing = append(missing, ip)
+		}
+	}
+	return missing
 }
 
 // DeviceInfo defines device orm info
@@ -2,7 +2,6 @@ package main
 
 import (
 	"errors"
-	"log"
 	"os"
 	"os/signal"
 
@@ -10,12 +9,6 @@ import (
 	"github.com/go-resty/resty/v2"
 )
 
-func checkErr(err error) {
-	if err != nil {
-		log.Panicln("Fatal:", err)
-	}
-}
-
 func newFSWatcher(files ...string) (*fsnotify.Watcher, error) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
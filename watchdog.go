@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"carizon-device-plugin/pkg/logger"
+)
+
+const (
+	registrationCheckInterval = 30 * time.Second
+	// registrationGracePeriod is the time given to kubelet to open the
+	// ListAndWatch stream after the plugin registered
+	registrationGracePeriod = 30 * time.Second
+)
+
+// markRegistered records that kubelet accepted the registration of the plugin
+func (h *CarizonDevicePlugin) markRegistered() {
+	h.Lock()
+	defer h.Unlock()
+	h.registeredAt = time.Now()
+}
+
+func (h *CarizonDevicePlugin) addWatcher(delta int) {
+	h.Lock()
+	defer h.Unlock()
+	h.watchers += delta
+}
+
+// checkRegistration returns an error when the plugin socket is gone or kubelet
+// has not watched the plugin since the grace period after its registration,
+// i.e. kubelet silently dropped the registration
+func (h *CarizonDevicePlugin) checkRegistration() error {
+	h.RLock()
+	registeredAt, watchers := h.registeredAt, h.watchers
+	h.RUnlock()
+
+	if registeredAt.IsZero() {
+		return nil
+	}
+	if _, err := os.Stat(h.socket); os.IsNotExist(err) {
+		return fmt.Errorf("socket %s removed", h.socket)
+	}
+	if watchers == 0 && time.Since(registeredAt) > registrationGracePeriod {
+		return errors.New("kubelet is not watching the plugin")
+	}
+	return nil
+}
+
+// Watch checks the registration of the running plugins every interval until
+// stop is closed, and restarts the plugins whose registration is lost
+func (s *PluginSupervisor) Watch(stop <-chan struct{}, interval time.Duration) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+
+		s.RLock()
+		for _, sp := range s.plugins {
+			sp.checkRegistration()
+		}
+		s.RUnlock()
+	}
+}
+
+// SocketRemoved checks right away the registration of the plugin serving on the
+// removed socket
+func (s *PluginSupervisor) SocketRemoved(socket string) {
+	s.RLock()
+	defer s.RUnlock()
+	for _, sp := range s.plugins {
+		if sp.plugin.socket == socket {
+			sp.checkRegistration()
+		}
+	}
+}
+
+// checkRegistration restarts the plugin if it is running but lost its registration.
+// Plugins being (re)started are skipped, their socket is expected to be missing.
+func (sp *supervisedPlugin) checkRegistration() {
+	sp.RLock()
+	state := sp.status.State
+	sp.RUnlock()
+	if state != PluginRunning {
+		return
+	}
+
+	if err := sp.plugin.checkRegistration(); err != nil {
+		logger.Wrapper.Errorf("[watchdog] Plugin %s lost its registration, re-registering: %s", sp.plugin.resourceName, err.Error())
+		sp.requestRestart()
+	}
+}